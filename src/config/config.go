@@ -11,16 +11,130 @@ import (
 type Server struct {
 	Host string
 	Port string
+	// Scheme is http or https
+	Scheme string `default:"http"`
+	// CA is a PEM bundle trusted instead of the system roots
+	CA string
+	// ClientCert and ClientKey are the PEM files presented to the server for mutual tls
+	ClientCert string
+	ClientKey  string
+	// Pins is a comma-separated list of base64 SHA-256 digests of public keys, one of which
+	// the server certificate chain must contain
+	Pins string
+	// Transport is poll, which asks for missions once a second, or longpoll, which keeps a request
+	// pending on the server
+	Transport string `default:"poll"`
+	// LongPollWait is the seconds the server may hold a long poll request
+	LongPollWait int `default:"25"`
+	// Secret is shared with the server to sign requests and responses, empty disables signing
+	Secret string `secret:"true"`
+	// SignatureWindow is the seconds a signed message's timestamp may differ from the local clock
+	SignatureWindow int `default:"300"`
 }
 
 type Path struct {
 	Work string
 	Data string
+	// Journal is the crash-safe journal of missions and statuses, defaults to judger.journal in Work
+	Journal string
+	// JournalCompaction is the number of missions finished since the last compaction from which the journal
+	// is compacted, 0 only compacts it on start
+	JournalCompaction int `default:"1000"`
+}
+
+// Golang configures the hermetic environment used to build go submissions
+type Golang struct {
+	// Cache is the GOCACHE shared by all builds
+	Cache string `default:"/tmp/openjudge-gocache"`
+	// Allowlist is a comma-separated list of importable packages, empty means the whole standard library
+	Allowlist string
+}
+
+// PreCheck configures the checks on source code before compiling,
+// banned patterns are regular expressions per language
+type PreCheck struct {
+	// MaxSourceSize is in bytes, 0 means unlimited
+	MaxSourceSize int `default:"0"`
+	BannedC       string
+	BannedCpp     string
+	BannedJava    string
+	BannedGo      string
+}
+
+// Judge configures the judge slots, each slot is pinned to a dedicated cpu
+type Judge struct {
+	// Slots is the number of concurrent runs, 0 means one per cpu, leaving one for compiling if no cpu
+	// is left otherwise
+	Slots int
+	// Cpus is a cpu list like 2-5,8, empty means every cpu the judger may run on
+	Cpus string
+	// AvoidSiblings keeps slots off hyperthread siblings of each other
+	AvoidSiblings bool
+	// ShutdownTimeout is the seconds running missions may take to finish before being cancelled
+	ShutdownTimeout int `default:"30"`
+	// FlushTimeout is the seconds spent sending pending statuses before exiting
+	FlushTimeout int `default:"30"`
+	// AcceptWindow is the seconds within which accepted missions must be able to start
+	AcceptWindow int `default:"10"`
+	// CompileCpus is a cpu list compilations are pinned to, empty means every cpu the judger may run on
+	// but the slots' ones, compilations never share a cpu with the slots
+	CompileCpus string
+	// CompileWorkers is the number of concurrent compilations, 0 means one per compile cpu
+	CompileWorkers int
+}
+
+// Queue configures the weights mission queues are served by, and the slots reserved for high-priority missions
+type Queue struct {
+	ContestWeight  int `default:"6"`
+	PracticeWeight int `default:"3"`
+	RejudgeWeight  int `default:"1"`
+	// ReservedSlots only run missions with a priority of at least HighPriority
+	ReservedSlots int
+	HighPriority  int `default:"10"`
+}
+
+// Cache configures the caches kept across missions
+type Cache struct {
+	Dir string `default:"/tmp/openjudge-cache"`
+	// ArtifactSize is the budget of compiled artifacts in MB, 0 disables the cache
+	ArtifactSize int `default:"1024"`
+	// TestCaseSize is the budget of test data in MB, the least recently judged problems are evicted beyond it,
+	// 0 means unlimited
+	TestCaseSize int
+	// Verdicts is the number of verdicts kept for identical submissions, 0 disables the cache
+	Verdicts int `default:"0"`
+}
+
+// Sync configures the retries of test case synchronization, each file is retried on its own
+type Sync struct {
+	// MaxAttempts is the number of tries of a file before the synchronization fails
+	MaxAttempts int `default:"5"`
+	// RetryDelay is the seconds before the first retry, doubled for every further one up to MaxRetryDelay
+	RetryDelay    int `default:"1"`
+	MaxRetryDelay int `default:"60"`
+	// CheckInterval is the seconds test data found up to date is trusted before missions of the problem
+	// check it again, 0 checks it for every mission
+	CheckInterval int `default:"60"`
+	// IdleTimeout is the seconds a download may go without receiving data before it is retried,
+	// 0 waits forever
+	IdleTimeout int `default:"30"`
+	// LockTimeout is the seconds an update waits for another judger process sharing the test data
+	// to finish with it
+	LockTimeout int `default:"600"`
+	// BundleThreshold is the number of changed files from which they are downloaded as one bundle,
+	// 0 always downloads file by file
+	BundleThreshold int `default:"2"`
 }
 
 type Config struct {
-	Path Path
-	Server Server
+	Path     Path
+	Server   Server
+	Golang   Golang   `section:"optional"`
+	PreCheck PreCheck `section:"optional"`
+	Judge    Judge    `section:"optional"`
+	Queue    Queue    `section:"optional"`
+	Cache    Cache    `section:"optional"`
+	Sync     Sync     `section:"optional"`
 }
 
 var GlobalConfig *Config
@@ -30,21 +144,42 @@ func initSectionConfig(sr *reflect.Value, dict map[string]string) {
 		Type := sr.Type().Field(i)
 		value := sr.Field(i)
 		name := strings.ToLower(Type.Name)
+		content, ok := dict[name]
+		if !ok {
+			content = Type.Tag.Get("default")
+		}
 		switch value.Type().Kind() {
 		case reflect.String:
 			{
-				value.SetString(dict[name])
+				value.SetString(content)
 			}
 		case reflect.Int:
 			{
-				number, err := strconv.Atoi(dict[name])
+				if content == "" {
+					break
+				}
+				number, err := strconv.Atoi(content)
 				if err != nil {
 					panic(err)
 				}
 				value.SetInt(int64(number))
 			}
+		case reflect.Bool:
+			{
+				if content == "" {
+					break
+				}
+				flag, err := strconv.ParseBool(content)
+				if err != nil {
+					panic(err)
+				}
+				value.SetBool(flag)
+			}
+		}
+		// secrets never reach the output
+		if Type.Tag.Get("secret") != "true" {
+			fmt.Println(name, content)
 		}
-		fmt.Println(name, dict[name])
 	}
 }
 
@@ -56,7 +191,10 @@ func initGlobalConfig(sr *reflect.Value, file *goconfig.ConfigFile) {
 		if value.Type().Kind() == reflect.Struct {
 			dict, err := file.GetSection(strings.ToLower(name))
 			if err != nil {
-				panic(err)
+				if Type.Tag.Get("section") != "optional" {
+					panic(err)
+				}
+				dict = map[string]string{}
 			}
 			fmt.Println("struct")
 			initSectionConfig(&value, dict)
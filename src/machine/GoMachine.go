@@ -1,13 +1,123 @@
 package machine
 
-import "os/exec"
+import (
+	"bytes"
+	"config"
+	"errors"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"model"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"utils"
+)
+
+var goToolchainLock sync.Mutex
+var goToolchainLoaded bool
+var goBinary, goVersion string
+var goAllowedPackages map[string]bool
 
 type GoMachine struct {
 	BaseMachine
 }
 
+// loadGoToolchain locates the go binary and collects its version and the importable packages,
+// a failure is a fault of the host, so it is left to the caller and the load is retried next time
+func loadGoToolchain() error {
+	goToolchainLock.Lock()
+	defer goToolchainLock.Unlock()
+	if goToolchainLoaded {
+		return nil
+	}
+	path, err := exec.LookPath("go")
+	if err != nil {
+		return errors.New("go toolchain not found")
+	}
+	goBinary = path
+	output, err := goToolCommand("", "env", "GOVERSION").Output()
+	if err == nil {
+		goVersion = strings.TrimPrefix(strings.TrimSpace(string(output)), "go")
+	}
+	allowedPackages := map[string]bool{}
+	if allowlist := config.GlobalConfig.Golang.Allowlist; allowlist != "" {
+		for _, pkg := range strings.Split(allowlist, ",") {
+			allowedPackages[strings.TrimSpace(pkg)] = true
+		}
+	} else {
+		output, err = goToolCommand("", "list", "std").Output()
+		if err != nil {
+			return errors.New("list go standard library fail: " + err.Error())
+		}
+		for _, pkg := range strings.Fields(string(output)) {
+			if !strings.Contains(pkg, "internal") && !strings.HasPrefix(pkg, "vendor/") {
+				allowedPackages[pkg] = true
+			}
+		}
+	}
+	goAllowedPackages = allowedPackages
+	goToolchainLoaded = true
+	return nil
+}
+
+// goToolCommand creates a go command running in a hermetic environment,
+// nothing is inherited from the judger and the network is never reached
+func goToolCommand(dir string, args ...string) *exec.Cmd {
+	home, tmp := dir, filepath.Join(dir, ".tmp")
+	if dir == "" {
+		home, tmp = os.TempDir(), os.TempDir()
+	}
+	cmd := exec.Command(goBinary, args...)
+	cmd.Dir = dir
+	cmd.Env = []string{
+		"PATH=" + filepath.Dir(goBinary) + ":/usr/bin:/bin",
+		"HOME=" + home,
+		"TMPDIR=" + tmp,
+		"GOPATH=" + filepath.Join(home, ".gopath"),
+		"GOCACHE=" + config.GlobalConfig.Golang.Cache,
+		"GOFLAGS=-mod=mod",
+		"GOPROXY=off",
+		"GOSUMDB=off",
+		"GO111MODULE=on",
+		"GOWORK=off",
+		"GOENV=off",
+		"GOTOOLCHAIN=local",
+		"GOTELEMETRY=off",
+		"CGO_ENABLED=0",
+	}
+	return cmd
+}
+
+// WarmUpGoBuildCache compiles the standard library into the shared build cache,
+// so that submissions don't pay for a cold build
+func WarmUpGoBuildCache() {
+	if err := loadGoToolchain(); err != nil {
+		utils.Log(utils.LogTypeError, "load go toolchain fail: "+err.Error())
+		return
+	}
+	utils.Log(utils.LogTypeNormal, "warm up go build cache "+config.GlobalConfig.Golang.Cache)
+	if err := os.MkdirAll(config.GlobalConfig.Golang.Cache, 0777); err != nil {
+		utils.Log(utils.LogTypeError, "create go build cache fail")
+		return
+	}
+	var stderr bytes.Buffer
+	cmd := goToolCommand("", "build", "std")
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		utils.Log(utils.LogTypeError, "warm up go build cache fail: "+stderr.String())
+		return
+	}
+	utils.Log(utils.LogTypeNormal, "warm up go build cache complete")
+}
+
 func (c *GoMachine) compileCommand() *exec.Cmd {
-	return exec.Command("go", "build", "-o", "main", "main.go")
+	args := append([]string{"build", "-trimpath", "-o", "main", "main.go"}, c.graderSources(".go")...)
+	return goToolCommand(c.workPath(), args...)
 }
 
 func (c *GoMachine) judgeCommand() *exec.Cmd {
@@ -17,3 +127,50 @@ func (c *GoMachine) judgeCommand() *exec.Cmd {
 func (c *GoMachine) sourceCodeFileName() string {
 	return "main.go"
 }
+
+func (c *GoMachine) parseDiagnostics(message string) []model.CompilationDiagnostic {
+	return parseGoDiagnostics(message)
+}
+
+// checkSource rejects imports out of the allowlist, they can't be built offline anyway,
+// the toolchain is loaded by prepareWorkSpace before
+func (c *GoMachine) checkSource() error {
+	fileSet := token.NewFileSet()
+	file, err := parser.ParseFile(fileSet, c.sourceCodeFileName(), c.Code, parser.ImportsOnly)
+	if err != nil {
+		// leave syntax errors to the compiler
+		return nil
+	}
+	for _, spec := range file.Imports {
+		path, _ := strconv.Unquote(spec.Path.Value)
+		if !goAllowedPackages[path] {
+			return fmt.Errorf("%s: import %q is not allowed", fileSet.Position(spec.Path.Pos()), path)
+		}
+	}
+	return nil
+}
+
+// includedFiles lists the files embedded through //go:embed, the package is listed once go.mod is written
+func (c *GoMachine) includedFiles() ([]string, error) {
+	output, err := c.outputOf(goToolCommand(c.workPath(), "list", "-f", "{{join .EmbedFiles \"\\n\"}}", "."))
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(output)), nil
+}
+
+// prepareWorkSpace writes go.mod so that the build runs in module mode, the mission is a system error
+// while the toolchain is unavailable
+func (c *GoMachine) prepareWorkSpace() error {
+	if err := loadGoToolchain(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.workPath()+"/.tmp", 0777); err != nil {
+		return err
+	}
+	goMod := "module main\n"
+	if parts := strings.Split(goVersion, "."); len(parts) >= 2 {
+		goMod += fmt.Sprintf("\ngo %s.%s\n", parts[0], parts[1])
+	}
+	return ioutil.WriteFile(c.workPath()+"/go.mod", []byte(goMod), 0644)
+}
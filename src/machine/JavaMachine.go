@@ -1,19 +1,86 @@
 package machine
 
-import "os/exec"
+import (
+	"io/ioutil"
+	"model"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+var javaCommentOrLiteralRegex = regexp.MustCompile("(?s)/\\*.*?\\*/|//[^\n]*|\"(?:\\\\.|[^\"\\\\\n])*\"|'(?:\\\\.|[^'\\\\\n])*'")
+var javaPackageRegex = regexp.MustCompile("(?m)^\\s*package\\s+([A-Za-z_$][\\w$]*(?:\\s*\\.\\s*[A-Za-z_$][\\w$]*)*)\\s*;")
+var javaMainMethodRegex = regexp.MustCompile("\\bstatic\\s+(?:final\\s+)?void\\s+main\\s*\\(")
+var javaPublicClassRegex = regexp.MustCompile("\\bpublic\\s+(?:(?:final|abstract|strictfp)\\s+)*(?:class|interface|enum|record)\\s+([A-Za-z_$][\\w$]*)")
 
 type JavaMachine struct {
 	BaseMachine
+	graderMainClass string
+}
+
+// javaClassName detects the package and the public class name declared in the source code,
+// falling back to the default package and Main
+func javaClassName(code string) (string, string) {
+	code = javaCommentOrLiteralRegex.ReplaceAllStringFunc(code, func(token string) string {
+		if strings.HasPrefix(token, "/") {
+			return " "
+		}
+		return "\"\""
+	})
+	packageName, className := "", "Main"
+	if result := javaPackageRegex.FindStringSubmatch(code); len(result) >= 2 {
+		packageName = strings.Join(strings.Fields(strings.ReplaceAll(result[1], ".", " ")), ".")
+	}
+	if result := javaPublicClassRegex.FindStringSubmatch(code); len(result) >= 2 {
+		className = result[1]
+	}
+	return packageName, className
+}
+
+func javaQualifiedClassName(code string) string {
+	packageName, className := javaClassName(code)
+	if packageName == "" {
+		return className
+	}
+	return packageName + "." + className
+}
+
+// mainClass is the fully-qualified name of the submitted class
+func (c *JavaMachine) mainClass() string {
+	return javaQualifiedClassName(c.Code)
+}
+
+// prepareWorkSpace finds the grader class declaring main, which is run instead of the submission
+func (c *JavaMachine) prepareWorkSpace() error {
+	for _, name := range c.graderSources(".java") {
+		content, err := ioutil.ReadFile(c.workPath() + "/" + name)
+		if err != nil {
+			return err
+		}
+		if javaMainMethodRegex.Match(content) {
+			c.graderMainClass = javaQualifiedClassName(string(content))
+		}
+	}
+	return nil
 }
 
 func (c *JavaMachine) compileCommand() *exec.Cmd {
-	return exec.Command("javac", "Main.java")
+	args := append([]string{"-encoding", "UTF-8", "-d", ".", c.sourceCodeFileName()}, c.graderSources(".java")...)
+	return exec.Command("javac", args...)
 }
 
 func (c *JavaMachine) judgeCommand() *exec.Cmd {
-	return exec.Command("java", "Main")
+	if c.graderMainClass != "" {
+		return exec.Command("java", "-cp", ".", c.graderMainClass)
+	}
+	return exec.Command("java", "-cp", ".", c.mainClass())
 }
 
+// sourceCodeFileName follows the package layout, e.g. com/example/Solution.java
 func (c *JavaMachine) sourceCodeFileName() string {
-	return "Main.java"
+	return strings.ReplaceAll(c.mainClass(), ".", "/") + ".java"
+}
+
+func (c *JavaMachine) parseDiagnostics(message string) []model.CompilationDiagnostic {
+	return parseJavacDiagnostics(message)
 }
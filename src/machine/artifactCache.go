@@ -0,0 +1,294 @@
+package machine
+
+import (
+	"config"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"model"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"utils"
+)
+
+// artifactEntry is a compiled artifact in the cache directory
+type artifactEntry struct {
+	size     int64
+	lastUsed time.Time
+}
+
+var artifactCacheOnce sync.Once
+var artifactEntries map[string]*artifactEntry
+var artifactCacheSize int64
+var artifactCacheLock sync.Mutex
+
+var compilerVersions sync.Map
+
+// compilerVersionArgs prints the version of each compiler
+var compilerVersionArgs = map[string][]string{
+	"gcc":   {"--version"},
+	"g++":   {"--version"},
+	"javac": {"-version"},
+	"go":    {"version"},
+}
+
+func artifactCacheDir() string {
+	return filepath.Join(config.GlobalConfig.Cache.Dir, "artifact")
+}
+
+func artifactCacheBudget() int64 {
+	return int64(config.GlobalConfig.Cache.ArtifactSize) * 1024 * 1024
+}
+
+// loadArtifactCache indexes the artifacts left by previous runs
+func loadArtifactCache() {
+	artifactCacheOnce.Do(func() {
+		artifactEntries = map[string]*artifactEntry{}
+		entries, err := ioutil.ReadDir(artifactCacheDir())
+		if err != nil {
+			return
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			size := directorySize(filepath.Join(artifactCacheDir(), entry.Name()))
+			artifactEntries[entry.Name()] = &artifactEntry{size: size, lastUsed: entry.ModTime()}
+			artifactCacheSize += size
+		}
+	})
+}
+
+func directorySize(dir string) int64 {
+	var size int64
+	_ = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// compilerVersion identifies the compiler, so that an upgrade invalidates the cache
+func compilerVersion(cmd *exec.Cmd) string {
+	if version, ok := compilerVersions.Load(cmd.Path); ok {
+		return version.(string)
+	}
+	args, ok := compilerVersionArgs[filepath.Base(cmd.Path)]
+	if !ok {
+		return ""
+	}
+	versionCmd := exec.Command(cmd.Path, args...)
+	versionCmd.Env = cmd.Env
+	output, err := versionCmd.CombinedOutput()
+	if err != nil {
+		return ""
+	}
+	version := strings.TrimSpace(string(output))
+	compilerVersions.Store(cmd.Path, version)
+	return version
+}
+
+// artifactKey hashes the language, the compile command, the compiler version,
+// the source code and the grader files
+func (m *BaseMachine) artifactKey(machine Machine) (string, error) {
+	cmd := machine.compileCommand()
+	version := compilerVersion(cmd)
+	if version == "" {
+		return "", fmt.Errorf("unknown compiler version of %s", cmd.Path)
+	}
+	hash := sha256.New()
+	// the workspace differs between missions
+	env := strings.ReplaceAll(strings.Join(cmd.Env, " "), m.workPath(), "")
+	_, _ = fmt.Fprintf(hash, "%d\x00%s\x00%s\x00%s\x00", m.Language, strings.Join(cmd.Args, " "), env, version)
+	_, _ = fmt.Fprintf(hash, "%s\x00%d\x00%s\x00", machine.sourceCodeFileName(), len(m.Code), m.Code)
+	graderFiles := append([]string{}, m.graderFiles...)
+	sort.Strings(graderFiles)
+	for _, name := range graderFiles {
+		content, err := ioutil.ReadFile(m.workPath() + "/" + name)
+		if err != nil {
+			return "", err
+		}
+		_, _ = fmt.Fprintf(hash, "%s\x00%d\x00", name, len(content))
+		_, _ = hash.Write(content)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// listWorkSpace lists the regular files of the workspace relative to it
+func (m *BaseMachine) listWorkSpace() map[string]bool {
+	files := map[string]bool{}
+	_ = filepath.Walk(m.workPath(), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() && strings.HasPrefix(info.Name(), ".") && path != m.workPath() {
+			return filepath.SkipDir
+		}
+		if info.Mode().IsRegular() {
+			relative, _ := filepath.Rel(m.workPath(), path)
+			files[relative] = true
+		}
+		return nil
+	})
+	return files
+}
+
+func copyFile(source string, target string, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0777); err != nil {
+		return err
+	}
+	sourceFile, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = sourceFile.Close()
+	}()
+	targetFile, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(targetFile, sourceFile); err != nil {
+		_ = targetFile.Close()
+		return err
+	}
+	return targetFile.Close()
+}
+
+// loadCompiledArtifact copies the cached artifact into the workspace, it reports whether the cache hit
+func (m *BaseMachine) loadCompiledArtifact(key string) bool {
+	loadArtifactCache()
+	artifactCacheLock.Lock()
+	defer artifactCacheLock.Unlock()
+	entry, ok := artifactEntries[key]
+	if !ok {
+		return false
+	}
+	dir := filepath.Join(artifactCacheDir(), key)
+	err := filepath.Walk(filepath.Join(dir, "files"), func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		relative, _ := filepath.Rel(filepath.Join(dir, "files"), path)
+		return copyFile(path, filepath.Join(m.workPath(), relative), info.Mode())
+	})
+	if err != nil {
+		m.LogWarning("load compiled artifact fail: " + err.Error())
+		return false
+	}
+	if message, err := ioutil.ReadFile(filepath.Join(dir, "compile.log")); err == nil {
+		_ = ioutil.WriteFile(m.workPath()+"/compile.log", message, 0644)
+	}
+	entry.lastUsed = time.Now()
+	_ = os.Chtimes(dir, entry.lastUsed, entry.lastUsed)
+	return true
+}
+
+// storeCompiledArtifact caches the files created by the compiler, then evicts the least recently used
+// artifacts beyond the budget
+func (m *BaseMachine) storeCompiledArtifact(key string, before map[string]bool) {
+	loadArtifactCache()
+	tempDir, err := ioutil.TempDir(artifactCacheDir(), ".store-")
+	if err != nil {
+		if err := os.MkdirAll(artifactCacheDir(), 0777); err != nil {
+			m.LogWarning("create artifact cache directory fail")
+			return
+		}
+		if tempDir, err = ioutil.TempDir(artifactCacheDir(), ".store-"); err != nil {
+			m.LogWarning("create artifact cache directory fail")
+			return
+		}
+	}
+	defer func() {
+		_ = os.RemoveAll(tempDir)
+	}()
+	for relative := range m.listWorkSpace() {
+		if before[relative] || relative == "compile.log" {
+			continue
+		}
+		source := filepath.Join(m.workPath(), relative)
+		info, err := os.Stat(source)
+		if err != nil {
+			return
+		}
+		if err := copyFile(source, filepath.Join(tempDir, "files", relative), info.Mode()); err != nil {
+			m.LogWarning("store compiled artifact fail: " + err.Error())
+			return
+		}
+	}
+	// the compile message is replayed in other workspaces
+	if message, err := ioutil.ReadFile(m.workPath() + "/compile.log"); err == nil {
+		_ = ioutil.WriteFile(filepath.Join(tempDir, "compile.log"), []byte(m.sanitizeCompilationMessage(string(message))), 0644)
+	}
+	size := directorySize(tempDir)
+
+	artifactCacheLock.Lock()
+	defer artifactCacheLock.Unlock()
+	if _, ok := artifactEntries[key]; ok {
+		return
+	}
+	if err := os.Rename(tempDir, filepath.Join(artifactCacheDir(), key)); err != nil {
+		m.LogWarning("store compiled artifact fail: " + err.Error())
+		return
+	}
+	artifactEntries[key] = &artifactEntry{size: size, lastUsed: time.Now()}
+	artifactCacheSize += size
+	m.LogNormal("compiled artifact cached")
+	evictArtifacts()
+}
+
+// evictArtifacts removes the least recently used artifacts until the cache fits the budget,
+// artifactCacheLock must be held
+func evictArtifacts() {
+	budget := artifactCacheBudget()
+	for artifactCacheSize > budget && len(artifactEntries) > 0 {
+		var oldestKey string
+		var oldest *artifactEntry
+		for key, entry := range artifactEntries {
+			if oldest == nil || entry.lastUsed.Before(oldest.lastUsed) {
+				oldestKey, oldest = key, entry
+			}
+		}
+		if err := os.RemoveAll(filepath.Join(artifactCacheDir(), oldestKey)); err != nil {
+			utils.Log(utils.LogTypeWarning, "evict compiled artifact fail: "+err.Error())
+			return
+		}
+		delete(artifactEntries, oldestKey)
+		artifactCacheSize -= oldest.size
+	}
+}
+
+// compileWithCache skips compiling when the artifact is cached, and caches what is compiled successfully
+func (m *BaseMachine) compileWithCache(ctx context.Context, machine Machine) {
+	if artifactCacheBudget() <= 0 {
+		m.compile(ctx, machine)
+		return
+	}
+	key, err := m.artifactKey(machine)
+	if err != nil {
+		m.LogWarning("skip compiled artifact cache: " + err.Error())
+		m.compile(ctx, machine)
+		return
+	}
+	if m.loadCompiledArtifact(key) {
+		m.LogNormal("compiled artifact cache hit")
+		m.Status = model.JudgeStatusWaitingRunning
+		m.readCompilationMessage(machine)
+		return
+	}
+	before := m.listWorkSpace()
+	m.compile(ctx, machine)
+	if m.Status == model.JudgeStatusWaitingRunning {
+		m.storeCompiledArtifact(key, before)
+	}
+}
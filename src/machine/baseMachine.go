@@ -2,16 +2,20 @@ package machine
 
 import (
 	"config"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"model"
 	"network"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
 	"syscall"
+	"testcase"
 	"time"
 	"utils"
 )
@@ -20,7 +24,19 @@ type Machine interface {
 	compileCommand() *exec.Cmd
 	judgeCommand() *exec.Cmd
 	sourceCodeFileName() string
-	Run(machine Machine)
+	parseDiagnostics(message string) []model.CompilationDiagnostic
+	Compile(ctx context.Context, machine Machine, cpu int) bool
+	Judge(ctx context.Context, machine Machine, cpu int) bool
+}
+
+// sourceChecker is implemented by machines which reject some source code before compiling
+type sourceChecker interface {
+	checkSource() error
+}
+
+// workSpacePreparer is implemented by machines which need extra files in the workspace
+type workSpacePreparer interface {
+	prepareWorkSpace() error
 }
 
 type BaseMachine struct {
@@ -31,11 +47,25 @@ type BaseMachine struct {
 	Status      model.JudgeStatus `json:"status"`
 	TimeLimit   int               `json:"time_limit"`
 	MemoryLimit int               `json:"memory_limit"`
+	// BannedPatterns are the per-problem banned constructs
+	BannedPatterns []string `json:"banned_patterns"`
+	// CPU is the compile cpu while compiling and the dedicated cpu of the judge slot while judging,
+	// -1 leaves the processes unpinned
+	CPU int `json:"cpu"`
+	// DisableVerdictCache judges the submission even if an identical one has been judged
+	DisableVerdictCache bool `json:"disable_verdict_cache"`
 
-	timeCost           int
-	memoryCost         int
-	compilationMessage string
-	inputFiles         []string
+	timeCost               int
+	memoryCost             int
+	compilationMessage     string
+	compilationDiagnostics []model.CompilationDiagnostic
+	reason                 string
+	inputFiles             []string
+	graderFiles            []string
+	cancelled              bool
+	verdictCacheKey        string
+	lease                  *testcase.Lease
+	reused                 bool
 	//currentCase int64
 	//caseCount   int64
 }
@@ -56,10 +86,39 @@ func (m *BaseMachine) workPath() string {
 	return config.GlobalConfig.Path.Work + strconv.FormatInt(m.Rid, 10)
 }
 
+// dataPath is the version of the testcase directory leased when the mission starts, so that the whole run
+// reads one version of the test data
 func (m *BaseMachine) dataPath() string {
+	if m.lease != nil {
+		return m.lease.Dir
+	}
 	return config.GlobalConfig.Path.Data + strconv.FormatInt(m.Pid, 10)
 }
 
+// runCommand runs the command on the compile cpu or the cpu of the judge slot,
+// the thread is locked and never unlocked so that the affinity dies with it
+func (m *BaseMachine) runCommand(cmd *exec.Cmd) error {
+	if m.CPU >= 0 {
+		runtime.LockOSThread()
+		if err := utils.SetThreadAffinity(m.CPU); err != nil {
+			m.LogWarning(fmt.Sprintf("pin to cpu %d fail: %s", m.CPU, err.Error()))
+		}
+	}
+	// run in a process group of its own, so that the whole tree can be killed
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	return cmd.Run()
+}
+
+// killCommand kills the process group of the command
+func (m *BaseMachine) killCommand(cmd *exec.Cmd) {
+	if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil {
+		_ = cmd.Process.Kill()
+	}
+}
+
 func (m *BaseMachine) initWorkSpace(machine Machine) {
 	m.LogNormal("start initializing workspace")
 	// calculate test case count
@@ -98,9 +157,21 @@ func (m *BaseMachine) initWorkSpace(machine Machine) {
 	}
 	m.LogNormal("work directory exist")
 
+	// copy grader files of function-signature problems
+	if err := m.copyGraderFiles(machine); err != nil {
+		m.Status = model.JudgeStatusSystemError
+		m.LogError("copy grader files fail: " + err.Error())
+		return
+	}
+
 	// save source code
 	sourceCodePath := fmt.Sprintf("%s%d/%s", config.GlobalConfig.Path.Work, m.Rid, machine.sourceCodeFileName())
 	m.LogNormal("save source code to " + sourceCodePath)
+	if err := os.MkdirAll(filepath.Dir(sourceCodePath), 0777); err != nil {
+		m.Status = model.JudgeStatusSystemError
+		m.LogError("create source code directory fail")
+		return
+	}
 	err = ioutil.WriteFile(sourceCodePath, []byte(m.Code), os.ModePerm)
 	if err != nil {
 		m.Status = model.JudgeStatusSystemError
@@ -109,10 +180,50 @@ func (m *BaseMachine) initWorkSpace(machine Machine) {
 	}
 	m.LogNormal("save source code success")
 
+	if preparer, ok := machine.(workSpacePreparer); ok {
+		m.LogNormal("prepare workspace")
+		if err := preparer.prepareWorkSpace(); err != nil {
+			m.Status = model.JudgeStatusSystemError
+			m.LogError("prepare workspace fail: " + err.Error())
+			return
+		}
+		m.LogNormal("prepare workspace success")
+	}
+
 	m.LogNormal("workspace initialization complete")
 }
 
-func (m *BaseMachine) compile(machine Machine) {
+func (m *BaseMachine) checkSource(machine Machine) {
+	err := m.checkGraderReference(machine)
+	if checker, ok := machine.(sourceChecker); ok && err == nil {
+		err = checker.checkSource()
+	}
+	if err != nil {
+		m.LogNormal("source code check fail: " + err.Error())
+		m.Status = model.JudgeStatusCompilationError
+		m.compilationMessage = err.Error()
+		m.compilationDiagnostics = machine.parseDiagnostics(err.Error())
+	}
+}
+
+// isCancelled reports whether the mission has been cancelled through ctx
+func (m *BaseMachine) isCancelled(ctx context.Context) bool {
+	if !m.cancelled && ctx.Err() != nil {
+		m.LogNormal("mission cancelled")
+		m.cancelled = true
+	}
+	return m.cancelled
+}
+
+func (m *BaseMachine) readCompilationMessage(machine Machine) {
+	if file, err := ioutil.ReadFile(m.workPath() + "/compile.log"); err == nil {
+		message := m.sanitizeCompilationMessage(string(file))
+		m.compilationMessage = truncateCompilationMessage(message)
+		m.compilationDiagnostics = machine.parseDiagnostics(message)
+	}
+}
+
+func (m *BaseMachine) compile(ctx context.Context, machine Machine) {
 	m.LogNormal("start compile source code")
 	cmd := machine.compileCommand()
 	cmd.Stdin = os.Stdin
@@ -127,16 +238,14 @@ func (m *BaseMachine) compile(machine Machine) {
 
 	defer func(compileMessageFile *os.File) {
 		_ = compileMessageFile.Close()
-		if file, err := ioutil.ReadFile(m.workPath() + "/compile.log"); err == nil {
-			m.compilationMessage = string(file)
-		}
+		m.readCompilationMessage(machine)
 		m.LogNormal("source code compiling complete")
 	}(compileMessageFile)
 	cmd.Stdout = compileMessageFile
 	cmd.Stderr = compileMessageFile
 	cmd.Dir = m.workPath()
 	go func() {
-		_ = cmd.Run()
+		_ = m.runCommand(cmd)
 		if cmd.Process == nil {
 			m.LogError("compiling fail, process not be created")
 			m.Status = model.JudgeStatusSystemError
@@ -148,6 +257,11 @@ func (m *BaseMachine) compile(machine Machine) {
 		if m.Status == model.JudgeStatusSystemError {
 			return
 		}
+		// kill the process tree once started
+		if m.isCancelled(ctx) && cmd.Process != nil {
+			m.killCommand(cmd)
+			return
+		}
 		// judge process after compile exited
 		if cmd.ProcessState != nil {
 			switch cmd.ProcessState.ExitCode() {
@@ -173,7 +287,7 @@ func (m *BaseMachine) compile(machine Machine) {
 		if cmd.Process != nil {
 			timeCost := utils.GetTimeUsed(cmd.Process.Pid)
 			if timeCost > 20*1000 {
-				_ = cmd.Process.Kill()
+				m.killCommand(cmd)
 				m.LogNormal("compiling time limit exceeded")
 				m.Status = model.JudgeStatusCompilationTimeLimitExceeded
 				return
@@ -183,7 +297,7 @@ func (m *BaseMachine) compile(machine Machine) {
 	}
 }
 
-func (m *BaseMachine) doJudge(machine Machine, inputFileName string) {
+func (m *BaseMachine) doJudge(ctx context.Context, machine Machine, inputFileName string) {
 	m.LogNormal(fmt.Sprintf("start judge use %s", inputFileName))
 	stdInputFile, err := os.Open(fmt.Sprintf("%s/%s", m.dataPath(), inputFileName))
 	if err != nil {
@@ -211,7 +325,7 @@ func (m *BaseMachine) doJudge(machine Machine, inputFileName string) {
 	cmd.Dir = m.workPath()
 
 	go func() {
-		_ = cmd.Run()
+		_ = m.runCommand(cmd)
 		if cmd.Process == nil {
 			m.LogError("judge fail, process not be created")
 			m.Status = model.JudgeStatusSystemError
@@ -228,6 +342,11 @@ func (m *BaseMachine) doJudge(machine Machine, inputFileName string) {
 		if m.Status == model.JudgeStatusSystemError {
 			return
 		}
+		// kill the process tree once started
+		if m.isCancelled(ctx) && cmd.Process != nil {
+			m.killCommand(cmd)
+			return
+		}
 		// judge process after judge exited
 		if cmd.ProcessState != nil {
 			if cmd.ProcessState.Success() {
@@ -242,21 +361,21 @@ func (m *BaseMachine) doJudge(machine Machine, inputFileName string) {
 		if cmd.Process != nil {
 			timeCost = utils.Max(timeCost, utils.GetTimeUsed(cmd.Process.Pid))
 			if timeCost > m.TimeLimit {
-				_ = cmd.Process.Kill()
+				m.killCommand(cmd)
 				m.LogNormal("judge time limit exceeded " + string(rune(timeCost)) + "ms")
 				m.Status = model.JudgeStatusTimeLimitExceeded
 				return
 			}
 			memoryCost = utils.Max(memoryCost, utils.GetMemoryUsed(cmd.Process.Pid))
 			if memoryCost > m.MemoryLimit {
-				_ = cmd.Process.Kill()
+				m.killCommand(cmd)
 				m.LogNormal("judge memory limit exceeded")
 				m.Status = model.JudgeStatusMemoryLimitExceeded
 				return
 			}
 			writeSize := utils.GetWriteBytes(cmd.Process.Pid)
 			if writeSize > 256000000 {
-				_ = cmd.Process.Kill()
+				m.killCommand(cmd)
 				m.LogNormal("judge output limit exceeded")
 				m.Status = model.JudgeStatusOutputLimitExceeded
 				return
@@ -310,13 +429,19 @@ func (m *BaseMachine) compareOutputFile(inputFileName string) {
 	}
 }
 
-func (m *BaseMachine) judge(machine Machine) {
+func (m *BaseMachine) judge(ctx context.Context, machine Machine) {
 	m.LogNormal("start judge")
 	for _, inputFileName := range m.inputFiles {
 		if m.Status != model.JudgeStatusWaitingRunning && m.Status != model.JudgeStatusPresentationError {
 			return
 		}
-		m.doJudge(machine, inputFileName)
+		if m.isCancelled(ctx) {
+			return
+		}
+		m.doJudge(ctx, machine, inputFileName)
+		if m.cancelled {
+			return
+		}
 		if m.Status == model.JudgeStatusWaitingRunning || m.Status == model.JudgeStatusPresentationError {
 			m.compareOutputFile(inputFileName)
 		}
@@ -335,29 +460,103 @@ func (m *BaseMachine) sendStatus() {
 		memoryCost = m.memoryCost
 	}
 	network.SendStatus(model.StatusModel{
-		Rid:                m.Rid,
-		Pid:                m.Pid,
-		Status:             m.Status,
-		TimeCost:           int64(timeCost),
-		MemoryCost:         int64(memoryCost),
-		CompilationMessage: m.compilationMessage,
+		Rid:                    m.Rid,
+		Pid:                    m.Pid,
+		Status:                 m.Status,
+		TimeCost:               int64(timeCost),
+		MemoryCost:             int64(memoryCost),
+		CompilationMessage:     m.compilationMessage,
+		CompilationDiagnostics: m.compilationDiagnostics,
+		Reason:                 m.reason,
+		Reused:                 m.reused,
 		//Percent:
 	})
 }
 
-func (m *BaseMachine) Run(machine Machine) {
+// abort cleans up the workspace of the cancelled mission, network decides what becomes of the mission
+func (m *BaseMachine) abort() {
+	if err := os.RemoveAll(m.workPath()); err != nil {
+		m.LogWarning("remove work directory fail")
+	}
+	m.releaseTestCase()
+	network.AbortMission(m.Rid, m.Pid)
+	m.LogNormal("mission aborted")
+}
+
+// releaseTestCase gives back the lease on the test data, so that pending updates of the problem can run
+func (m *BaseMachine) releaseTestCase() {
+	if m.lease != nil {
+		m.lease.Release()
+	}
+}
+
+// Compile prepares the workspace and compiles the submission pinned to cpu unless it is -1, it reports whether
+// the mission is ready to judge, once ctx is done the running processes are killed and the mission aborted
+func (m *BaseMachine) Compile(ctx context.Context, machine Machine, cpu int) bool {
 	m.LogNormal("mission start")
+	m.CPU = cpu
+	lease, err := testcase.Store.Acquire(m.Pid)
+	if err != nil {
+		// the mission waits for the test data in network rather than holding the worker
+		m.LogNormal("test case unavailable: " + err.Error())
+		network.RequeueMission(m.Rid, m.Pid)
+		return false
+	}
+	m.lease = lease
 	m.Status = model.JudgeStatusCompiling
 	m.timeCost = -1
 	m.memoryCost = -1
 	m.sendStatus()
+	if reason := m.preCheck(); reason != "" {
+		m.LogNormal("submission rejected: " + reason)
+		m.Status = model.JudgeStatusSubmissionRejected
+		m.reason = reason
+		m.sendStatus()
+		m.releaseTestCase()
+		m.LogNormal("mission complete")
+		return false
+	}
 	m.initWorkSpace(machine)
-	m.compile(machine)
-	m.sendStatus()
-	if m.Status == model.JudgeStatusWaitingRunning {
-		m.judge(machine)
+	if m.Status == model.JudgeStatusCompiling {
+		m.checkSource(machine)
+	}
+	if m.Status == model.JudgeStatusCompiling && m.loadVerdict(machine) {
+		m.removeGraderFiles()
 		m.sendStatus()
+		m.releaseTestCase()
+		m.LogNormal("mission complete")
+		return false
+	}
+	if m.Status == model.JudgeStatusCompiling && !m.isCancelled(ctx) {
+		m.compileWithCache(ctx, machine)
+	}
+	m.removeGraderFiles()
+	if m.cancelled {
+		m.abort()
+		return false
+	}
+	m.sendStatus()
+	if m.Status != model.JudgeStatusWaitingRunning {
+		m.storeVerdict()
+		m.releaseTestCase()
+		m.LogNormal("mission complete")
+		return false
 	}
+	return true
+}
 
+// Judge runs the compiled submission against the test cases, pinned to cpu unless it is -1, it reports
+// whether the run completed rather than being aborted
+func (m *BaseMachine) Judge(ctx context.Context, machine Machine, cpu int) bool {
+	m.CPU = cpu
+	m.judge(ctx, machine)
+	if m.cancelled {
+		m.abort()
+		return false
+	}
+	m.sendStatus()
+	m.storeVerdict()
+	m.releaseTestCase()
 	m.LogNormal("mission complete")
+	return true
 }
@@ -1,13 +1,21 @@
 package machine
 
-import "os/exec"
+import (
+	"model"
+	"os/exec"
+)
 
 type CMachine struct {
 	BaseMachine
 }
 
 func (c *CMachine) compileCommand() *exec.Cmd {
-	return exec.Command("gcc", "-g", "-Wall", "-o", "main", "main.c")
+	args := append([]string{"-g", "-Wall", "-o", "main", "main.c"}, c.graderSources(".c")...)
+	return exec.Command("gcc", args...)
+}
+
+func (c *CMachine) includedFiles() ([]string, error) {
+	return c.gccIncludedFiles("gcc", c.sourceCodeFileName())
 }
 
 func (c *CMachine) judgeCommand() *exec.Cmd {
@@ -17,3 +25,7 @@ func (c *CMachine) judgeCommand() *exec.Cmd {
 func (c *CMachine) sourceCodeFileName() string {
 	return "main.c"
 }
+
+func (c *CMachine) parseDiagnostics(message string) []model.CompilationDiagnostic {
+	return parseGccDiagnostics(message)
+}
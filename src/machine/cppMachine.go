@@ -1,13 +1,21 @@
 package machine
 
-import "os/exec"
+import (
+	"model"
+	"os/exec"
+)
 
 type CppMachine struct {
 	BaseMachine
 }
 
 func (c *CppMachine) compileCommand() *exec.Cmd {
-	return exec.Command("g++", "-g", "-Wall", "-o", "main", "main.cpp")
+	args := append([]string{"-g", "-Wall", "-o", "main", "main.cpp"}, c.graderSources(".cpp", ".cc", ".cxx")...)
+	return exec.Command("g++", args...)
+}
+
+func (c *CppMachine) includedFiles() ([]string, error) {
+	return c.gccIncludedFiles("g++", c.sourceCodeFileName())
 }
 
 func (c *CppMachine) judgeCommand() *exec.Cmd {
@@ -17,3 +25,7 @@ func (c *CppMachine) judgeCommand() *exec.Cmd {
 func (c *CppMachine) sourceCodeFileName() string {
 	return "main.cpp"
 }
+
+func (c *CppMachine) parseDiagnostics(message string) []model.CompilationDiagnostic {
+	return parseGccDiagnostics(message)
+}
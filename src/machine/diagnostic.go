@@ -0,0 +1,131 @@
+package machine
+
+import (
+	"config"
+	"fmt"
+	"model"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const maxCompilationMessageLength = 64 * 1024
+const maxCompilationDiagnostics = 100
+
+var gccDiagnosticRegex = regexp.MustCompile("^(.+?):(\\d+):(?:(\\d+):)? (fatal error|error|warning|note): (.*)$")
+var javacDiagnosticRegex = regexp.MustCompile("^(.+?\\.java):(\\d+): (error|warning|note): (.*)$")
+var javacCaretRegex = regexp.MustCompile("^(\\s*)\\^\\s*$")
+var goDiagnosticRegex = regexp.MustCompile("^(.+?\\.go):(\\d+):(\\d+): (.*)$")
+
+// sanitizeCompilationMessage hides host paths from the contestant, a path followed by a file name is cut
+// off and a bare path becomes ".", a longer name sharing the prefix, e.g. another workspace, is left alone
+func (m *BaseMachine) sanitizeCompilationMessage(message string) string {
+	for _, path := range []string{m.workPath(), m.dataPath(), config.GlobalConfig.Path.Work, config.GlobalConfig.Path.Data} {
+		path = strings.TrimSuffix(path, "/")
+		if path == "" {
+			continue
+		}
+		pathRegex := regexp.MustCompile(regexp.QuoteMeta(path) + "(/|[^\\w.-]|$)")
+		message = pathRegex.ReplaceAllStringFunc(message, func(match string) string {
+			next := match[len(path):]
+			if next == "/" {
+				return ""
+			}
+			return "." + next
+		})
+	}
+	return message
+}
+
+// truncateCompilationMessage cuts the message at a rune boundary, so that it stays valid utf-8
+func truncateCompilationMessage(message string) string {
+	if len(message) <= maxCompilationMessageLength {
+		return message
+	}
+	cut := maxCompilationMessageLength
+	for cut > 0 && !utf8.RuneStart(message[cut]) {
+		cut--
+	}
+	return fmt.Sprintf("%s\n... (%d bytes truncated)", message[:cut], len(message)-cut)
+}
+
+func appendDiagnostic(diagnostics []model.CompilationDiagnostic, diagnostic model.CompilationDiagnostic) []model.CompilationDiagnostic {
+	if len(diagnostics) >= maxCompilationDiagnostics {
+		return diagnostics
+	}
+	return append(diagnostics, diagnostic)
+}
+
+// parseGccDiagnostics parses gcc and g++ output, e.g. main.cpp:3:5: error: 'x' was not declared
+func parseGccDiagnostics(message string) []model.CompilationDiagnostic {
+	var diagnostics []model.CompilationDiagnostic
+	for _, line := range strings.Split(message, "\n") {
+		result := gccDiagnosticRegex.FindStringSubmatch(line)
+		if len(result) < 6 {
+			continue
+		}
+		lineNumber, _ := strconv.Atoi(result[2])
+		column, _ := strconv.Atoi(result[3])
+		severity := model.DiagnosticSeverity(result[4])
+		if severity == "fatal error" {
+			severity = model.DiagnosticSeverityError
+		}
+		diagnostics = appendDiagnostic(diagnostics, model.CompilationDiagnostic{
+			File:     result[1],
+			Line:     lineNumber,
+			Column:   column,
+			Severity: severity,
+			Message:  result[5],
+		})
+	}
+	return diagnostics
+}
+
+// parseJavacDiagnostics parses javac output, the column comes from the caret line below the source line
+func parseJavacDiagnostics(message string) []model.CompilationDiagnostic {
+	var diagnostics []model.CompilationDiagnostic
+	lines := strings.Split(message, "\n")
+	for i, line := range lines {
+		result := javacDiagnosticRegex.FindStringSubmatch(line)
+		if len(result) < 5 {
+			continue
+		}
+		lineNumber, _ := strconv.Atoi(result[2])
+		diagnostic := model.CompilationDiagnostic{
+			File:     result[1],
+			Line:     lineNumber,
+			Severity: model.DiagnosticSeverity(result[3]),
+			Message:  result[4],
+		}
+		for j := i + 1; j < len(lines) && j <= i+2; j++ {
+			if caret := javacCaretRegex.FindStringSubmatch(lines[j]); len(caret) >= 2 {
+				diagnostic.Column = len(caret[1]) + 1
+				break
+			}
+		}
+		diagnostics = appendDiagnostic(diagnostics, diagnostic)
+	}
+	return diagnostics
+}
+
+// parseGoDiagnostics parses go build output, e.g. ./main.go:3:5: undefined: x
+func parseGoDiagnostics(message string) []model.CompilationDiagnostic {
+	var diagnostics []model.CompilationDiagnostic
+	for _, line := range strings.Split(message, "\n") {
+		result := goDiagnosticRegex.FindStringSubmatch(strings.TrimPrefix(line, "./"))
+		if len(result) < 5 {
+			continue
+		}
+		lineNumber, _ := strconv.Atoi(result[2])
+		column, _ := strconv.Atoi(result[3])
+		diagnostics = appendDiagnostic(diagnostics, model.CompilationDiagnostic{
+			File:     result[1],
+			Line:     lineNumber,
+			Column:   column,
+			Severity: model.DiagnosticSeverityError,
+			Message:  result[4],
+		})
+	}
+	return diagnostics
+}
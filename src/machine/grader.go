@@ -0,0 +1,213 @@
+package machine
+
+import (
+	"bytes"
+	"config"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// graderDirectoryName is the directory under the testcase directory holding the files
+// supplied by function-signature problems, e.g. grader.cpp, grader.h, Grader.java
+const graderDirectoryName = "grader"
+
+const compileTimeLimit = 20 * time.Second
+
+var graderHeaderExtensions = []string{".h", ".hh", ".hpp", ".hxx"}
+
+func (m *BaseMachine) graderPath() string {
+	return m.dataPath() + "/" + graderDirectoryName
+}
+
+// copyGraderFiles copies the grader files into the workspace, problems without a grader are left untouched
+func (m *BaseMachine) copyGraderFiles(machine Machine) error {
+	files, err := ioutil.ReadDir(m.graderPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, file := range files {
+		if !file.Mode().IsRegular() {
+			continue
+		}
+		if file.Name() == filepath.Base(machine.sourceCodeFileName()) {
+			return fmt.Errorf("grader file %s conflicts with source code", file.Name())
+		}
+		content, err := ioutil.ReadFile(m.graderPath() + "/" + file.Name())
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(m.workPath()+"/"+file.Name(), content, 0600); err != nil {
+			return err
+		}
+		m.graderFiles = append(m.graderFiles, file.Name())
+	}
+	m.LogNormal(fmt.Sprintf("copy %d grader file(s)", len(m.graderFiles)))
+	return nil
+}
+
+// graderSources returns the grader files the compiler has to link with the submission,
+// every grader file but headers without extensions
+func (m *BaseMachine) graderSources(extensions ...string) []string {
+	var sources []string
+	for _, name := range m.graderFiles {
+		if len(extensions) == 0 && !isGraderHeader(name) {
+			sources = append(sources, name)
+		}
+		for _, extension := range extensions {
+			if strings.HasSuffix(name, extension) {
+				sources = append(sources, name)
+				break
+			}
+		}
+	}
+	return sources
+}
+
+func isGraderHeader(name string) bool {
+	for _, extension := range graderHeaderExtensions {
+		if strings.HasSuffix(name, extension) {
+			return true
+		}
+	}
+	return false
+}
+
+// includeLister is implemented by machines whose source code can pull other files in while compiling,
+// e.g. through #include or //go:embed
+type includeLister interface {
+	// includedFiles lists the files pulled in, relative to the workspace, the error carries the output
+	// of the tool when it fails
+	includedFiles() ([]string, error)
+}
+
+// checkGraderReference rejects source code which pulls grader sources in, to print them in compile errors
+// or read them while running, grader headers are meant to be included. The files are listed by the
+// toolchain itself, so that macros and line splicing are resolved the way the compiler resolves them
+func (m *BaseMachine) checkGraderReference(machine Machine) error {
+	lister, ok := machine.(includeLister)
+	if !ok || len(m.graderSources()) == 0 {
+		return nil
+	}
+	files, err := lister.includedFiles()
+	if err != nil {
+		// leave the failure to the compiler, unless its output shows a grader source
+		for _, name := range m.graderSources() {
+			if strings.Contains(err.Error(), name) {
+				return fmt.Errorf("%s: grader file %s must not be included", machine.sourceCodeFileName(), name)
+			}
+		}
+		m.LogNormal("list included files fail")
+		return nil
+	}
+	for _, file := range files {
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(m.workPath(), file)
+		}
+		if name := m.graderSourceOf(file); name != "" {
+			return fmt.Errorf("%s: grader file %s must not be included", machine.sourceCodeFileName(), name)
+		}
+		// test data, the originals of the grader files included, is never meant to be included
+		inData := isWithin(file, config.GlobalConfig.Path.Data) && !isWithin(file, m.workPath())
+		if inData || isWithin(file, m.graderPath()) {
+			return fmt.Errorf("%s: test data %s must not be included", machine.sourceCodeFileName(), filepath.Base(file))
+		}
+	}
+	return nil
+}
+
+// graderSourceOf returns the name of the grader source the file is, either the copy in the workspace or
+// the original in the testcase directory, whatever path leads to it
+func (m *BaseMachine) graderSourceOf(file string) string {
+	info, err := os.Stat(file)
+	if err != nil {
+		return ""
+	}
+	for _, name := range m.graderSources() {
+		for _, grader := range []string{filepath.Join(m.workPath(), name), filepath.Join(m.graderPath(), name)} {
+			if graderInfo, err := os.Stat(grader); err == nil && os.SameFile(info, graderInfo) {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// isWithin reports whether the file is inside dir, both taken as they are and with symlinks resolved
+func isWithin(file string, dir string) bool {
+	if dir == "" {
+		return false
+	}
+	files, dirs := []string{filepath.Clean(file)}, []string{filepath.Clean(dir)}
+	if resolved, err := filepath.EvalSymlinks(file); err == nil {
+		files = append(files, resolved)
+	}
+	if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+		dirs = append(dirs, resolved)
+	}
+	for _, file := range files {
+		for _, dir := range dirs {
+			if relative, err := filepath.Rel(dir, file); err == nil && relative != ".." && !strings.HasPrefix(relative, "../") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// outputOf runs the command in the workspace like a compiler and returns its output,
+// it is killed after the compile time limit
+func (m *BaseMachine) outputOf(cmd *exec.Cmd) ([]byte, error) {
+	var output bytes.Buffer
+	cmd.Dir = m.workPath()
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	result := make(chan error, 1)
+	go func() {
+		result <- m.runCommand(cmd)
+	}()
+	select {
+	case err := <-result:
+		if err != nil {
+			return nil, errors.New(output.String())
+		}
+		return output.Bytes(), nil
+	case <-time.After(compileTimeLimit):
+		if cmd.Process != nil {
+			m.killCommand(cmd)
+		}
+		<-result
+		return nil, errors.New("time limit exceeded")
+	}
+}
+
+// gccIncludedFiles lists the files included by the source code from the make rule printed by gcc -MM,
+// missing headers are listed rather than failing
+func (m *BaseMachine) gccIncludedFiles(compiler string, sourceCodeFileName string) ([]string, error) {
+	output, err := m.outputOf(exec.Command(compiler, "-MM", "-MG", sourceCodeFileName))
+	if err != nil {
+		return nil, err
+	}
+	rule := strings.ReplaceAll(string(output), "\\\n", " ")
+	if index := strings.Index(rule, ":"); index >= 0 {
+		rule = rule[index+1:]
+	}
+	return strings.Fields(rule), nil
+}
+
+// removeGraderFiles removes the grader files once compiled, so that the submission can't read them while running
+func (m *BaseMachine) removeGraderFiles() {
+	for _, name := range m.graderFiles {
+		if err := os.Remove(m.workPath() + "/" + name); err != nil && !os.IsNotExist(err) {
+			m.LogWarning("remove grader file " + name + " fail")
+		}
+	}
+}
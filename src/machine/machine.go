@@ -0,0 +1,40 @@
+package machine
+
+import "model"
+
+// NewMachine creates the machine judging the mission, nil if the language isn't supported
+func NewMachine(mission *model.MissionModel) Machine {
+	baseMachine := BaseMachine{
+		Rid:                 mission.Rid,
+		Pid:                 mission.Pid,
+		Code:                mission.Code,
+		Language:            mission.Language,
+		Status:              model.JudgeStatusWaiting,
+		TimeLimit:           mission.TimeLimit,
+		MemoryLimit:         mission.MemoryLimit,
+		BannedPatterns:      mission.BannedPatterns,
+		CPU:                 -1,
+		DisableVerdictCache: mission.DisableVerdictCache,
+	}
+	switch mission.Language {
+	case model.LanguageC:
+		return &CMachine{
+			BaseMachine: baseMachine,
+		}
+	case model.LanguageCpp:
+		return &CppMachine{
+			BaseMachine: baseMachine,
+		}
+	case model.LanguageJava:
+		return &JavaMachine{
+			BaseMachine: baseMachine,
+		}
+	case model.LanguageGo:
+		return &GoMachine{
+			BaseMachine: baseMachine,
+		}
+	default:
+		// TODO: log language error
+	}
+	return nil
+}
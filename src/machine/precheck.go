@@ -0,0 +1,71 @@
+package machine
+
+import (
+	"config"
+	"fmt"
+	"model"
+	"regexp"
+	"strings"
+	"sync"
+	"utils"
+)
+
+var bannedPatternsOnce sync.Once
+var languageBannedPatterns map[model.Language]*regexp.Regexp
+
+func loadLanguageBannedPatterns() {
+	bannedPatternsOnce.Do(func() {
+		languageBannedPatterns = map[model.Language]*regexp.Regexp{}
+		preCheck := config.GlobalConfig.PreCheck
+		for language, pattern := range map[model.Language]string{
+			model.LanguageC:    preCheck.BannedC,
+			model.LanguageCpp:  preCheck.BannedCpp,
+			model.LanguageJava: preCheck.BannedJava,
+			model.LanguageGo:   preCheck.BannedGo,
+		} {
+			if pattern == "" {
+				continue
+			}
+			reg, err := regexp.Compile(pattern)
+			if err != nil {
+				utils.Log(utils.LogTypeError, fmt.Sprintf("[Language:%d] invalid banned pattern %s", language, pattern))
+				continue
+			}
+			languageBannedPatterns[language] = reg
+		}
+	})
+}
+
+// matchBannedPattern describes where the source code matches the pattern, or returns an empty string
+func (m *BaseMachine) matchBannedPattern(reg *regexp.Regexp) string {
+	location := reg.FindStringIndex(m.Code)
+	if location == nil {
+		return ""
+	}
+	line := strings.Count(m.Code[:location[0]], "\n") + 1
+	return fmt.Sprintf("banned construct %q at line %d", m.Code[location[0]:location[1]], line)
+}
+
+// preCheck validates the submission before anything is written to disk or compiled
+func (m *BaseMachine) preCheck() string {
+	if limit := config.GlobalConfig.PreCheck.MaxSourceSize; limit > 0 && len(m.Code) > limit {
+		return fmt.Sprintf("source code is %d bytes, exceeds the limit of %d bytes", len(m.Code), limit)
+	}
+	loadLanguageBannedPatterns()
+	if reg, ok := languageBannedPatterns[m.Language]; ok {
+		if reason := m.matchBannedPattern(reg); reason != "" {
+			return reason
+		}
+	}
+	for _, pattern := range m.BannedPatterns {
+		reg, err := regexp.Compile(pattern)
+		if err != nil {
+			m.LogWarning("invalid banned pattern " + pattern)
+			continue
+		}
+		if reason := m.matchBannedPattern(reg); reason != "" {
+			return reason
+		}
+	}
+	return ""
+}
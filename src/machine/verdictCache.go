@@ -0,0 +1,119 @@
+package machine
+
+import (
+	"config"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"model"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// verdict is a final result which can be reused for an identical submission on identical test data
+type verdict struct {
+	key                    string
+	status                 model.JudgeStatus
+	timeCost               int
+	memoryCost             int
+	compilationMessage     string
+	compilationDiagnostics []model.CompilationDiagnostic
+}
+
+var verdictList = list.New()
+var verdictElements = map[string]*list.Element{}
+var verdictLock sync.Mutex
+
+// testCaseVersion is the data version of the leased test data, without one the content of the testcase
+// directory is identified by the name, size and modification time of every file
+func (m *BaseMachine) testCaseVersion() (string, error) {
+	if version := m.lease.Version; version != "" {
+		return "manifest:" + version, nil
+	}
+	hash := sha256.New()
+	err := filepath.Walk(m.dataPath(), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			relative, _ := filepath.Rel(m.dataPath(), path)
+			_, _ = fmt.Fprintf(hash, "%s\x00%d\x00%d\x00", relative, info.Size(), info.ModTime().UnixNano())
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// verdictKey hashes the problem, the test data version, the compiled artifact key and the limits
+func (m *BaseMachine) verdictKey(machine Machine) (string, error) {
+	version, err := m.testCaseVersion()
+	if err != nil {
+		return "", err
+	}
+	artifactKey, err := m.artifactKey(machine)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%d\x00%s\x00%s\x00%d\x00%d", m.Pid, version, artifactKey, m.TimeLimit, m.MemoryLimit)))
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// loadVerdict reuses the cached verdict of an identical submission, it reports whether the cache hit
+func (m *BaseMachine) loadVerdict(machine Machine) bool {
+	if config.GlobalConfig.Cache.Verdicts <= 0 || m.DisableVerdictCache {
+		return false
+	}
+	key, err := m.verdictKey(machine)
+	if err != nil {
+		m.LogWarning("skip verdict cache: " + err.Error())
+		return false
+	}
+	m.verdictCacheKey = key
+	verdictLock.Lock()
+	defer verdictLock.Unlock()
+	element, ok := verdictElements[key]
+	if !ok {
+		return false
+	}
+	verdictList.MoveToFront(element)
+	cached := element.Value.(*verdict)
+	m.Status = cached.status
+	m.timeCost = cached.timeCost
+	m.memoryCost = cached.memoryCost
+	m.compilationMessage = cached.compilationMessage
+	m.compilationDiagnostics = cached.compilationDiagnostics
+	m.reused = true
+	m.LogNormal(fmt.Sprintf("reuse cached verdict %d", m.Status))
+	return true
+}
+
+// storeVerdict caches the final verdict, system errors are never cached
+func (m *BaseMachine) storeVerdict() {
+	if m.verdictCacheKey == "" || m.reused || !m.Status.IsFinished() || m.Status == model.JudgeStatusSystemError {
+		return
+	}
+	verdictLock.Lock()
+	defer verdictLock.Unlock()
+	if element, ok := verdictElements[m.verdictCacheKey]; ok {
+		verdictList.MoveToFront(element)
+		return
+	}
+	verdictElements[m.verdictCacheKey] = verdictList.PushFront(&verdict{
+		key:                    m.verdictCacheKey,
+		status:                 m.Status,
+		timeCost:               m.timeCost,
+		memoryCost:             m.memoryCost,
+		compilationMessage:     m.compilationMessage,
+		compilationDiagnostics: m.compilationDiagnostics,
+	})
+	for verdictList.Len() > config.GlobalConfig.Cache.Verdicts {
+		oldest := verdictList.Back()
+		verdictList.Remove(oldest)
+		delete(verdictElements, oldest.Value.(*verdict).key)
+	}
+}
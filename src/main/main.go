@@ -1,53 +1,57 @@
 package main
 
 import (
+	"config"
+	"context"
+	"fmt"
 	"machine"
-	"model"
 	"network"
+	"os"
+	"os/signal"
+	"scheduler"
+	"syscall"
 	"time"
+	"utils"
 )
 
 func main() {
+	fetchCtx, stopFetching := context.WithCancel(context.Background())
+	runCtx, cancelRuns := context.WithCancel(context.Background())
+	networkCtx, stopNetwork := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	pool := scheduler.NewPool()
+	network.SetSlotCount(pool.Size())
+	network.RecoverJournal()
+	networkDone := make(chan struct{})
 	go func() {
-		network.StartNetworkModule()
+		network.StartNetworkModule(networkCtx)
+		close(networkDone)
 	}()
-	for ; ;  {
-		time.Sleep(time.Millisecond)
-		mission := network.FetchMission()
-		if mission == nil {
-			continue
-		}
-		var m machine.Machine
-		baseMachine := machine.BaseMachine{
-			Rid:         mission.Rid,
-			Pid:         mission.Pid,
-			Code:        mission.Code,
-			Status:      model.JudgeStatusWaiting,
-			TimeLimit:   mission.TimeLimit,
-			MemoryLimit: mission.MemoryLimit,
-		}
-		switch mission.Language {
-		case model.LanguageC:
-			m = &machine.CMachine{
-				BaseMachine: baseMachine,
-			}
-		case model.LanguageCpp:
-			m = &machine.CppMachine{
-				BaseMachine: baseMachine,
-			}
-		case model.LanguageJava:
-			m = &machine.JavaMachine{
-				BaseMachine: baseMachine,
-			}
-		case model.LanguageGo:
-			m = &machine.GoMachine{
-				BaseMachine: baseMachine,
-			}
-		default:
-			// TODO: log language error
-		}
-		go m.Run(m)
+	go machine.WarmUpGoBuildCache()
+	workersDone := scheduler.NewPipeline(pool).Start(fetchCtx, runCtx)
+
+	sig := <-signals
+	utils.Log(utils.LogTypeNormal, fmt.Sprintf("receive %s, shutting down", sig))
+	// stop accepting missions and let running ones finish
+	network.StartDraining()
+	stopFetching()
+	judgeConfig := config.GlobalConfig.Judge
+	select {
+	case <-workersDone:
+	case <-time.After(time.Duration(judgeConfig.ShutdownTimeout) * time.Second):
+		utils.Log(utils.LogTypeWarning, "shutdown timeout, cancel running missions")
+		cancelRuns()
+		<-workersDone
 	}
+	cancelRuns()
+	// hand back what is left and flush statuses
+	stopNetwork()
+	<-networkDone
+	network.ReturnQueuedMissions()
+	network.Flush(time.Now().Add(time.Duration(judgeConfig.FlushTimeout) * time.Second))
+	utils.Log(utils.LogTypeNormal, "shutdown complete")
 }
 
 //cat /boot/config-`uname -r` | grep '^CONFIG_HZ='
@@ -33,6 +33,35 @@ const (
 	JudgeStatusWrongAnswer                              = 10
 	JudgeStatusAccept                                   = 11
 	JudgeStatusWaitingRunning                           = 12
+	JudgeStatusSubmissionRejected                       = 13
+)
+
+// IsFinished reports whether the status is a final verdict
+func (s JudgeStatus) IsFinished() bool {
+	switch s {
+	case JudgeStatusSystemError,
+		JudgeStatusCompilationError,
+		JudgeStatusCompilationTimeLimitExceeded,
+		JudgeStatusTimeLimitExceeded,
+		JudgeStatusMemoryLimitExceeded,
+		JudgeStatusOutputLimitExceeded,
+		JudgeStatusRuntimeError,
+		JudgeStatusPresentationError,
+		JudgeStatusWrongAnswer,
+		JudgeStatusAccept,
+		JudgeStatusSubmissionRejected:
+		return true
+	}
+	return false
+}
+
+// QueueClass separates missions served by weight, e.g. contest verdicts aren't delayed by rejudges
+type QueueClass string
+
+const (
+	QueueClassContest  QueueClass = "contest"
+	QueueClassPractice QueueClass = "practice"
+	QueueClassRejudge  QueueClass = "rejudge"
 )
 
 type MissionModel struct {
@@ -42,10 +71,32 @@ type MissionModel struct {
 	Language    Language `json:"language"`
 	TimeLimit   int      `json:"time_limit"`
 	MemoryLimit int      `json:"memory_limit"`
+	// BannedPatterns are regular expressions the source code must not match
+	BannedPatterns []string `json:"banned_patterns,omitempty"`
+	// Priority orders missions within a queue, higher first
+	Priority int        `json:"priority"`
+	Queue    QueueClass `json:"queue"`
+	// DisableVerdictCache opts out of reusing verdicts, for problems with nondeterministic checkers
+	DisableVerdictCache bool `json:"disable_verdict_cache,omitempty"`
 	//currentCase int64
 	//caseCount   int64
 }
 
+type CommandType string
+
+const (
+	CommandTypeCancel  CommandType = "cancel"
+	CommandTypeRejudge CommandType = "rejudge"
+)
+
+// CommandModel is sent by the server to cancel or rejudge a mission
+type CommandModel struct {
+	Type CommandType `json:"type"`
+	Rid  int64       `json:"rid"`
+	// Mission replaces the mission to rejudge, the judger's own copy is used if absent
+	Mission *MissionModel `json:"mission,omitempty"`
+}
+
 func (m *MissionModel) LogFetchSuccess() {
 
 }
@@ -54,13 +105,36 @@ func (m *MissionModel) LogDispatchSuccess() {
 
 }
 
+type DiagnosticSeverity string
+
+const (
+	DiagnosticSeverityError   DiagnosticSeverity = "error"
+	DiagnosticSeverityWarning DiagnosticSeverity = "warning"
+	DiagnosticSeverityNote    DiagnosticSeverity = "note"
+)
+
+// CompilationDiagnostic is a single compiler message, paths are relative to the workspace
+type CompilationDiagnostic struct {
+	File     string             `json:"file"`
+	Line     int                `json:"line"`
+	Column   int                `json:"column,omitempty"`
+	Severity DiagnosticSeverity `json:"severity"`
+	Message  string             `json:"message"`
+}
+
 type StatusModel struct {
-	Rid                int64       `json:"rid"`
-	Pid                int64       `json:"pid"`
-	Status             JudgeStatus `json:"status"`
-	TimeCost           int64       `json:"time_cost,omitempty"`
-	MemoryCost         int64       `json:"memory_cost,omitempty"`
-	CompilationMessage string      `json:"compilation_message,omitempty"`
+	// Seq identifies the status among those sent by the judger
+	Seq                    int64                   `json:"seq"`
+	Rid                    int64                   `json:"rid"`
+	Pid                    int64                   `json:"pid"`
+	Status                 JudgeStatus             `json:"status"`
+	TimeCost               int64                   `json:"time_cost,omitempty"`
+	MemoryCost             int64                   `json:"memory_cost,omitempty"`
+	CompilationMessage     string                  `json:"compilation_message,omitempty"`
+	CompilationDiagnostics []CompilationDiagnostic `json:"compilation_diagnostics,omitempty"`
+	Reason                 string                  `json:"reason,omitempty"`
+	// Reused is set when the verdict is taken from an identical submission on identical test data
+	Reused bool `json:"reused,omitempty"`
 	//Percent float32     `json:"percent"`
 }
 
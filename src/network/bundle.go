@@ -0,0 +1,109 @@
+package network
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"config"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sync/atomic"
+	"testcase"
+)
+
+var errBundleUnsupported = errors.New("bundle unsupported")
+
+// bundleUnsupported is set once the server turns out to have no bundle endpoint, so that it isn't asked again
+var bundleUnsupported int32
+
+type syncTestCaseBundleRequestModel struct {
+	Pid       int64    `json:"pid"`
+	Filenames []string `json:"filenames"`
+}
+
+// downloadTestCaseBundle extracts the files from a tar.gz into the staging directory, every entry must be
+// a regular file wanted by the plan and match its manifest entry, it returns the names extracted so far
+// even on error, so that the rest can be downloaded file by file
+func downloadTestCaseBundle(pid int64, files []testcase.File, stagingDir string) (map[string]bool, error) {
+	extracted := map[string]bool{}
+	wanted := map[string]testcase.File{}
+	filenames := make([]string, 0, len(files))
+	for _, file := range files {
+		wanted[file.Name] = file
+		filenames = append(filenames, file.Name)
+	}
+	body, err := transport.DownloadTestCaseBundle(context.Background(), pid, filenames)
+	if err != nil {
+		return extracted, err
+	}
+	defer func() {
+		_ = body.Close()
+	}()
+	gzipReader, err := gzip.NewReader(body)
+	if err != nil {
+		return extracted, err
+	}
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return extracted, err
+		}
+		if header.Typeflag == tar.TypeDir {
+			continue
+		}
+		if !testcase.IsSafeName(header.Name) {
+			return extracted, fmt.Errorf("unsafe bundle entry %q", header.Name)
+		}
+		file, ok := wanted[header.Name]
+		if !ok || header.Typeflag != tar.TypeReg {
+			return extracted, fmt.Errorf("unexpected bundle entry %q", header.Name)
+		}
+		if err := writeFileAtomically(filepath.Join(stagingDir, file.Name), tarReader, file); err != nil {
+			return extracted, fmt.Errorf("[filename:%s] %s", file.Name, err.Error())
+		}
+		extracted[file.Name] = true
+	}
+	// the signature of the response is verified at the end of the body
+	if _, err := io.Copy(ioutil.Discard, body); err != nil {
+		return extracted, err
+	}
+	return extracted, nil
+}
+
+// downloadBundleIfWorth downloads the files as one bundle when there are enough of them and the server
+// supports it, it returns the files left to download one by one
+func downloadBundleIfWorth(pid int64, files []testcase.File, stagingDir string) []testcase.File {
+	threshold := config.GlobalConfig.Sync.BundleThreshold
+	if threshold <= 0 || len(files) < threshold || atomic.LoadInt32(&bundleUnsupported) == 1 {
+		return files
+	}
+	LogNormal(pid, fmt.Sprintf("download bundle of %d file(s)", len(files)))
+	extracted, err := downloadTestCaseBundle(pid, files, stagingDir)
+	if errors.Is(err, errBundleUnsupported) {
+		LogNormal(pid, "server has no bundle, download file by file")
+		atomic.StoreInt32(&bundleUnsupported, 1)
+		return files
+	}
+	if errors.Is(err, errBadSignature) {
+		LogError(pid, "reject bundle: "+err.Error())
+	} else if err != nil {
+		LogWarning(pid, "download bundle fail: "+err.Error())
+	}
+	var rest []testcase.File
+	for _, file := range files {
+		if !extracted[file.Name] {
+			rest = append(rest, file)
+		}
+	}
+	if err == nil && len(rest) > 0 {
+		LogWarning(pid, fmt.Sprintf("%d file(s) missing from bundle", len(rest)))
+	}
+	return rest
+}
@@ -0,0 +1,157 @@
+package network
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testcase"
+	"testing"
+)
+
+// bundleTransport serves a prepared body as the bundle, the other calls aren't expected
+type bundleTransport struct {
+	Transport
+	body []byte
+}
+
+func (t *bundleTransport) DownloadTestCaseBundle(ctx context.Context, pid int64, filenames []string) (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(t.body)), nil
+}
+
+type bundleEntry struct {
+	header tar.Header
+	data   string
+}
+
+func regularEntry(name string, data string) bundleEntry {
+	return bundleEntry{header: tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data))}, data: data}
+}
+
+func makeBundle(t *testing.T, entries []bundleEntry) []byte {
+	var buffer bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buffer)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for _, entry := range entries {
+		header := entry.header
+		if err := tarWriter.WriteHeader(&header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tarWriter.Write([]byte(entry.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func manifestFile(name string, data string) testcase.File {
+	digest := sha256.Sum256([]byte(data))
+	return testcase.File{Name: name, Size: int64(len(data)), SHA256: hex.EncodeToString(digest[:])}
+}
+
+func TestDownloadTestCaseBundle(t *testing.T) {
+	files := []testcase.File{manifestFile("1.in", "1 2\n"), manifestFile("data/1.out", "3\n")}
+	tests := []struct {
+		name      string
+		entries   []bundleEntry
+		extracted []string
+		err       string
+	}{
+		{
+			name:      "regular files",
+			entries:   []bundleEntry{regularEntry("1.in", "1 2\n"), regularEntry("data/1.out", "3\n")},
+			extracted: []string{"1.in", "data/1.out"},
+		},
+		{
+			name: "directories are skipped",
+			entries: []bundleEntry{
+				{header: tar.Header{Name: "data/", Typeflag: tar.TypeDir, Mode: 0755}},
+				regularEntry("data/1.out", "3\n"),
+			},
+			extracted: []string{"data/1.out"},
+		},
+		{
+			name:      "path traversal",
+			entries:   []bundleEntry{regularEntry("1.in", "1 2\n"), regularEntry("../1.out", "3\n")},
+			extracted: []string{"1.in"},
+			err:       "unsafe bundle entry",
+		},
+		{
+			name:    "absolute path",
+			entries: []bundleEntry{regularEntry("/tmp/1.in", "1 2\n")},
+			err:     "unsafe bundle entry",
+		},
+		{
+			name:    "hidden file",
+			entries: []bundleEntry{regularEntry(testcase.ManifestFileName, "{}")},
+			err:     "unsafe bundle entry",
+		},
+		{
+			name:    "file not asked for",
+			entries: []bundleEntry{regularEntry("2.in", "4 5\n")},
+			err:     "unexpected bundle entry",
+		},
+		{
+			name:    "symlink",
+			entries: []bundleEntry{{header: tar.Header{Name: "1.in", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"}}},
+			err:     "unexpected bundle entry",
+		},
+		{
+			name:    "hard link",
+			entries: []bundleEntry{{header: tar.Header{Name: "1.in", Typeflag: tar.TypeLink, Linkname: "data/1.out"}}},
+			err:     "unexpected bundle entry",
+		},
+		{
+			name:      "content mismatch",
+			entries:   []bundleEntry{regularEntry("1.in", "1 2\n"), regularEntry("data/1.out", "4\n")},
+			extracted: []string{"1.in"},
+			err:       "size or sha256 mismatch",
+		},
+	}
+	defer func(saved Transport) {
+		transport = saved
+	}(transport)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stagingDir, err := ioutil.TempDir("", "bundle-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				_ = os.RemoveAll(stagingDir)
+			}()
+			transport = &bundleTransport{body: makeBundle(t, test.entries)}
+			extracted, err := downloadTestCaseBundle(1, files, stagingDir)
+			if test.err == "" && err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Fatalf("error %v, want %q", err, test.err)
+			}
+			if len(extracted) != len(test.extracted) {
+				t.Fatalf("extracted %v, want %v", extracted, test.extracted)
+			}
+			for _, name := range test.extracted {
+				if !extracted[name] {
+					t.Fatalf("extracted %v, want %v", extracted, test.extracted)
+				}
+				if _, err := os.Stat(filepath.Join(stagingDir, name)); err != nil {
+					t.Fatalf("%s not written: %v", name, err)
+				}
+			}
+		})
+	}
+}
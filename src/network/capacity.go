@@ -0,0 +1,71 @@
+package network
+
+import (
+	"config"
+	"sync"
+	"time"
+)
+
+// averageRunWeight is the weight of the latest run in the moving average of run durations
+const averageRunWeight = 0.2
+
+var slotCount int
+var averageRunDuration time.Duration
+var capacityLock sync.Mutex
+
+// SetSlotCount tells the network module how many missions can run at once
+func SetSlotCount(count int) {
+	capacityLock.Lock()
+	slotCount = count
+	capacityLock.Unlock()
+}
+
+// observeRunDuration updates the moving average of run durations
+func observeRunDuration(duration time.Duration) {
+	capacityLock.Lock()
+	if averageRunDuration == 0 {
+		averageRunDuration = duration
+	} else {
+		averageRunDuration = time.Duration(averageRunWeight*float64(duration) + (1-averageRunWeight)*float64(averageRunDuration))
+	}
+	capacityLock.Unlock()
+}
+
+// queueDepth is the number of missions accepted but not dispatched yet
+func queueDepth() int {
+	missionLock.Lock()
+	depth := queuedMissionCount()
+	missionLock.Unlock()
+	lockedMissionLock.Lock()
+	for _, missions := range lockedMission {
+		depth += len(missions)
+	}
+	lockedMissionLock.Unlock()
+	return depth
+}
+
+// capacity reports the free slots, the queue depth and how many more missions can be started
+// within the accept window, judged from the average run duration
+func capacity() (int, int, int) {
+	countLock.Lock()
+	running := judgingCount
+	countLock.Unlock()
+	depth := queueDepth()
+	capacityLock.Lock()
+	slots, average := slotCount, averageRunDuration
+	capacityLock.Unlock()
+
+	freeSlots := slots - running
+	if freeSlots < 0 {
+		freeSlots = 0
+	}
+	startable := freeSlots
+	window := time.Duration(config.GlobalConfig.Judge.AcceptWindow) * time.Second
+	if average > 0 {
+		startable += int(int64(slots) * int64(window) / int64(average))
+	}
+	if isDraining() || startable < depth {
+		return freeSlots, depth, 0
+	}
+	return freeSlots, depth, startable - depth
+}
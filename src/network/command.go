@@ -0,0 +1,167 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"model"
+	"sync"
+	"time"
+	"utils"
+)
+
+// runningMission is a mission dispatched to a worker, command is set once the server cancels or rejudges it
+type runningMission struct {
+	mission model.MissionModel
+	cancel  context.CancelFunc
+	command *model.CommandModel
+}
+
+var runningMissions = map[int64]*runningMission{}
+var runLock sync.Mutex
+
+// registerRun is called when a mission is dispatched, so that commands arriving before the run starts aren't lost
+func registerRun(mission model.MissionModel) {
+	runLock.Lock()
+	runningMissions[mission.Rid] = &runningMission{mission: mission}
+	runLock.Unlock()
+}
+
+// StartRun returns the context of the dispatched mission, it is done once the server cancels or rejudges
+// the mission, done must be called when the run completes. Only runs judged to the end tell done so,
+// missions requeued, aborted, rejected or reused before judging would drag the average run duration down
+func StartRun(parent context.Context, rid int64) (context.Context, func(judged bool)) {
+	ctx, cancel := context.WithCancel(parent)
+	start := time.Now()
+	runLock.Lock()
+	run, ok := runningMissions[rid]
+	if ok {
+		run.cancel = cancel
+		if run.command != nil {
+			cancel()
+		}
+	}
+	runLock.Unlock()
+	return ctx, func(judged bool) {
+		runLock.Lock()
+		if runningMissions[rid] == run {
+			delete(runningMissions, rid)
+		}
+		runLock.Unlock()
+		cancel()
+		if judged {
+			observeRunDuration(time.Since(start))
+		}
+	}
+}
+
+// RequeueMission is called when a dispatched mission can't start because the test data of its problem is
+// being updated or gone, the mission is accepted again to wait for the test data unless the server cancelled
+// or rejudged it meanwhile
+func RequeueMission(rid int64, pid int64) {
+	runLock.Lock()
+	run := runningMissions[rid]
+	if run == nil || run.command != nil {
+		runLock.Unlock()
+		AbortMission(rid, pid)
+		return
+	}
+	delete(runningMissions, rid)
+	runLock.Unlock()
+	finishMission(pid)
+	lockedMissionLock.Lock()
+	delete(testCaseChecked, pid)
+	lockedMissionLock.Unlock()
+	LogNormal(pid, fmt.Sprintf("[Rid:%d] wait for test case again", rid))
+	acceptMission(run.mission)
+}
+
+// AbortMission is called when the run of a dispatched mission has been cancelled,
+// depending on why the mission is dropped, requeued or handed back to the server
+func AbortMission(rid int64, pid int64) {
+	runLock.Lock()
+	run := runningMissions[rid]
+	delete(runningMissions, rid)
+	runLock.Unlock()
+	finishMission(pid)
+	if run == nil || run.command == nil {
+		LogNormal(pid, fmt.Sprintf("[Rid:%d] hand back mission", rid))
+		returnMission(rid)
+		return
+	}
+	switch run.command.Type {
+	case model.CommandTypeCancel:
+		LogNormal(pid, fmt.Sprintf("[Rid:%d] mission cancelled", rid))
+		journalCancel(rid)
+	case model.CommandTypeRejudge:
+		LogNormal(pid, fmt.Sprintf("[Rid:%d] rejudge mission", rid))
+		acceptMission(rejudgeMission(run.mission, run.command.Mission))
+	}
+}
+
+// rejudgeMission picks the mission to judge again, the server's replacement keeps its own class,
+// anything else goes to the rejudge queue so it doesn't delay live verdicts
+func rejudgeMission(mission model.MissionModel, replacement *model.MissionModel) model.MissionModel {
+	if replacement != nil {
+		mission = *replacement
+	}
+	if replacement == nil || mission.Queue == "" {
+		mission.Queue = model.QueueClassRejudge
+	}
+	// journaled again so that a restart doesn't bring back the original class
+	journalMission(mission)
+	return mission
+}
+
+// removeQueuedMission removes a mission not dispatched yet
+func removeQueuedMission(rid int64) (model.MissionModel, bool) {
+	missionLock.Lock()
+	mission, ok := removeMission(rid)
+	missionLock.Unlock()
+	if ok {
+		return mission, true
+	}
+	lockedMissionLock.Lock()
+	defer lockedMissionLock.Unlock()
+	for pid, missions := range lockedMission {
+		for i, mission := range missions {
+			if mission.Rid == rid {
+				lockedMission[pid] = append(missions[:i:i], missions[i+1:]...)
+				return mission, true
+			}
+		}
+	}
+	return model.MissionModel{}, false
+}
+
+// handleCommand cancels or rejudges a mission, whether it is queued or running
+func handleCommand(command model.CommandModel) {
+	utils.Log(utils.LogTypeNormal, fmt.Sprintf("[Rid:%d] receive %s command", command.Rid, command.Type))
+	if command.Type != model.CommandTypeCancel && command.Type != model.CommandTypeRejudge {
+		utils.Log(utils.LogTypeWarning, fmt.Sprintf("[Rid:%d] unknown command %s", command.Rid, command.Type))
+		return
+	}
+	runLock.Lock()
+	if run, ok := runningMissions[command.Rid]; ok {
+		run.command = &command
+		if run.cancel != nil {
+			run.cancel()
+		}
+		runLock.Unlock()
+		return
+	}
+	runLock.Unlock()
+
+	mission, queued := removeQueuedMission(command.Rid)
+	switch command.Type {
+	case model.CommandTypeCancel:
+		if queued {
+			journalCancel(command.Rid)
+		}
+	case model.CommandTypeRejudge:
+		if command.Mission == nil && !queued {
+			utils.Log(utils.LogTypeWarning, fmt.Sprintf("[Rid:%d] mission to rejudge not found", command.Rid))
+			return
+		}
+		acceptMission(rejudgeMission(mission, command.Mission))
+	}
+}
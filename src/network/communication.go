@@ -1,92 +1,177 @@
 package network
 
 import (
-	"bytes"
 	"config"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"model"
-	"net/http"
 	"sync"
+	"testcase"
 	"time"
 	"utils"
 )
 
-var url string
-
 var judgingCount int
-var judgingStatus map[int64]int64
 var countLock sync.Mutex
 
 var statusList []model.StatusModel
+var statusSeq int64
 var statusLock sync.Mutex
 
-var missionList []model.MissionModel
+// statusPending is closed and replaced whenever a status or a handed back mission is waiting to be sent
+var statusPending = make(chan struct{})
+var pendingLock sync.Mutex
+
 var missionLock sync.Mutex
 
+// missionArrived is closed and replaced whenever missions are queued, waking up every waiting worker
+var missionArrived = make(chan struct{})
+
 var lockedMission map[int64][]model.MissionModel
 var lockedMissionLock sync.Mutex
 
-var syncingPid map[int64]bool
+// testCaseChecked is when the test data of a problem was last found up to date, testCaseChecking is set
+// while it is being checked, both are guarded by lockedMissionLock
+var testCaseChecked = map[int64]time.Time{}
+var testCaseChecking = map[int64]bool{}
 
 type MissionRequestModel struct {
 	Status       []model.StatusModel `json:"status"`
 	JudgingCount int                 `json:"judging_count"`
+	// ReturnedRids are missions handed back unjudged, the server should requeue them
+	ReturnedRids []int64 `json:"returned_rids,omitempty"`
+	// Draining tells the server not to send missions any more
+	Draining bool `json:"draining,omitempty"`
+	// FreeSlots is the number of idle judge slots
+	FreeSlots int `json:"free_slots"`
+	// QueueDepth is the number of missions waiting for a slot
+	QueueDepth int `json:"queue_depth"`
+	// Capacity is the maximum number of missions the judger accepts in the response
+	Capacity int `json:"capacity"`
 }
 
 type MissionResponseModel struct {
 	Problems []model.MissionModel `json:"problems"`
+	Commands []model.CommandModel `json:"commands"`
 }
 
 func init() {
 	judgingCount = 0
-	syncingPid = map[int64]bool{}
-	judgingStatus = map[int64]int64{}
+	statusSeq = time.Now().UnixNano()
 	lockedMission = map[int64][]model.MissionModel{}
-	url = "http://" + config.GlobalConfig.Server.Host + ":" + config.GlobalConfig.Server.Port + "/api/core/j2s/"
+	initMissionQueues()
+	transport = newTransport()
 }
 
-func FetchMission() *model.MissionModel {
-	var mission *model.MissionModel
+// appendMissions queues missions and wakes up the waiting workers
+func appendMissions(missions ...model.MissionModel) {
+	if len(missions) == 0 {
+		return
+	}
 	missionLock.Lock()
-	if len(missionList) > 0 {
-		mission = &missionList[0]
-		missionList = missionList[1:]
+	for _, mission := range missions {
+		pushMission(mission)
+	}
+	close(missionArrived)
+	missionArrived = make(chan struct{})
+	missionLock.Unlock()
+}
+
+// popMission takes the next mission and counts it as judging, missionLock must be held
+func popMission(highPriorityOnly bool) *model.MissionModel {
+	mission := selectMission(highPriorityOnly)
+	if mission != nil {
+		registerRun(*mission)
 		countLock.Lock()
 		judgingCount++
-		count := judgingStatus[mission.Pid]
-		judgingStatus[mission.Pid] = count + 1
 		countLock.Unlock()
 	}
-	missionLock.Unlock()
 	return mission
 }
 
+// FetchMission blocks until a mission arrives, it returns nil once ctx is done,
+// workers of reserved slots only take high-priority missions
+func FetchMission(ctx context.Context, highPriorityOnly bool) *model.MissionModel {
+	for {
+		missionLock.Lock()
+		mission := popMission(highPriorityOnly)
+		arrived := missionArrived
+		missionLock.Unlock()
+		if mission != nil {
+			return mission
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-arrived:
+		}
+	}
+}
+
 func SendStatus(statusModel model.StatusModel) {
 	statusLock.Lock()
+	journaled := queueStatus(statusModel)
+	if statusModel.Status.IsFinished() {
+		finishMission(statusModel.Pid)
+	}
+	statusLock.Unlock()
+	syncJournal(journaled)
+}
+
+// queueStatus numbers and journals the status for sending, statusLock must be held, the returned journal
+// number is synced by the caller once statusLock is released
+func queueStatus(statusModel model.StatusModel) int64 {
+	statusSeq++
+	statusModel.Seq = statusSeq
+	journaled := journalStatus(statusModel)
 	statusList = append(statusList, statusModel)
-	switch statusModel.Status {
-	case model.JudgeStatusSystemError,
-		model.JudgeStatusCompilationError,
-		model.JudgeStatusCompilationTimeLimitExceeded,
-		model.JudgeStatusTimeLimitExceeded,
-		model.JudgeStatusMemoryLimitExceeded,
-		model.JudgeStatusOutputLimitExceeded,
-		model.JudgeStatusRuntimeError,
-		model.JudgeStatusPresentationError,
-		model.JudgeStatusWrongAnswer,
-		model.JudgeStatusAccept:
-		countLock.Lock()
-		judgingCount--
-		count := judgingStatus[statusModel.Pid]
-		judgingStatus[statusModel.Pid] = count - 1
-		if judgingStatus[statusModel.Pid] == 0 {
-			SyncTestCase(statusModel.Pid)
-		}
-		countLock.Unlock()
+	notifyPending()
+	return journaled
+}
+
+// failLockedMissions reports a system error for the missions waiting for the test cases of pid,
+// they have never been dispatched so the judging count is left alone
+func failLockedMissions(pid int64, reason string) {
+	lockedMissionLock.Lock()
+	failed := lockedMission[pid]
+	lockedMission[pid] = nil
+	lockedMissionLock.Unlock()
+	var journaled int64
+	statusLock.Lock()
+	for _, mission := range failed {
+		LogError(pid, fmt.Sprintf("[Rid:%d] %s", mission.Rid, reason))
+		journaled = queueStatus(model.StatusModel{
+			Rid:        mission.Rid,
+			Pid:        mission.Pid,
+			Status:     model.JudgeStatusSystemError,
+			TimeCost:   -1,
+			MemoryCost: -1,
+			Reason:     reason,
+		})
 	}
 	statusLock.Unlock()
+	syncJournal(journaled)
+}
+
+func notifyPending() {
+	pendingLock.Lock()
+	close(statusPending)
+	statusPending = make(chan struct{})
+	pendingLock.Unlock()
+}
+
+func pendingSignal() <-chan struct{} {
+	pendingLock.Lock()
+	defer pendingLock.Unlock()
+	return statusPending
+}
+
+// finishMission releases the judging count of a dispatched mission
+func finishMission(pid int64) {
+	countLock.Lock()
+	judgingCount--
+	countLock.Unlock()
 }
 
 func LogNormal(pid int64, content string) {
@@ -99,81 +184,188 @@ func LogError(pid int64, content string) {
 	utils.Log(utils.LogTypeError, fmt.Sprintf("[Pid:%d] %s", pid, content))
 }
 
-func fetchMissionAndSendStatus() {
+// exchange sends a request through send and handles the answer, it reports whether the server answered.
+// withStatus attaches pending statuses and handed back missions, withCapacity asks for missions
+func exchange(ctx context.Context, send func(context.Context, MissionRequestModel) (*MissionResponseModel, error), withStatus bool, withCapacity bool) bool {
+	requestModel := MissionRequestModel{}
 	statusLock.Lock()
-	sendCount := utils.Min(len(statusList), 20)
-	for i := 0; i < sendCount; i++ {
-		statusList[i].LogTrySend()
+	sendCount := 0
+	if withStatus {
+		sendCount = utils.Min(len(statusList), 20)
+		for i := 0; i < sendCount; i++ {
+			statusList[i].LogTrySend()
+		}
+		requestModel.Status = statusList[:sendCount]
 	}
-	requestModel := MissionRequestModel{
-		Status:       statusList[:sendCount],
-		JudgingCount: judgingCount,
+	requestModel.JudgingCount = judgingCount
+	statusLock.Unlock()
+	returnedLock.Lock()
+	if withStatus {
+		requestModel.ReturnedRids = returnedRids
 	}
+	requestModel.Draining = draining
+	returnedLock.Unlock()
+	requestModel.FreeSlots, requestModel.QueueDepth, requestModel.Capacity = capacity()
+	if !withCapacity {
+		requestModel.Capacity = 0
+	}
+	responseModel, err := send(ctx, requestModel)
+	if err != nil {
+		if errors.Is(err, errBadSignature) {
+			utils.Log(utils.LogTypeError, "reject server response: "+err.Error())
+		}
+		return false
+	}
+	statusLock.Lock()
+	for i := 0; i < sendCount; i++ {
+		statusList[i].LogSendSuccess()
+	}
+	journaled := journalAck(statusList[:sendCount])
+	statusList = statusList[sendCount:]
 	statusLock.Unlock()
-	client := http.Client{Timeout: 30 * time.Second}
-	data, _ := json.Marshal(requestModel)
-	response, err := client.Post(url, "application/json", bytes.NewBuffer(data))
-	if err == nil {
-		body, err := ioutil.ReadAll(response.Body)
-		if err == nil {
-			var responseModel MissionResponseModel
-			err := json.Unmarshal(body, &responseModel)
-			if err == nil {
-				statusLock.Lock()
-				for i := 0; i < sendCount; i++ {
-					statusList[i].LogSendSuccess()
-				}
-				statusList = statusList[sendCount:]
-				statusLock.Unlock()
-				for _, mission := range responseModel.Problems {
-					if needSync, _ := CheckTestCaseWithPid(mission.Pid); needSync == true {
-						lockedMissionLock.Lock()
-						lockedMission[mission.Pid] = append(lockedMission[mission.Pid], mission)
-						lockedMissionLock.Unlock()
-						LogNormal(mission.Pid, fmt.Sprintf("judging count: %d", judgingStatus[mission.Pid]))
-						if judgingStatus[mission.Pid] == 0 {
-							SyncTestCase(mission.Pid)
-						}
-					} else {
-						missionLock.Lock()
-						missionList = append(missionList, mission)
-						missionLock.Unlock()
-					}
-				}
-			}
+	syncJournal(journaled)
+	journalReturn(requestModel.ReturnedRids)
+	returnedLock.Lock()
+	returnedRids = returnedRids[len(requestModel.ReturnedRids):]
+	returnedLock.Unlock()
+	for i, mission := range responseModel.Problems {
+		if isDraining() {
+			LogNormal(mission.Pid, fmt.Sprintf("[Rid:%d] draining, hand back mission", mission.Rid))
+			returnMission(mission.Rid)
+			continue
 		}
-		_ = response.Body.Close()
+		if i >= requestModel.Capacity {
+			LogWarning(mission.Pid, fmt.Sprintf("[Rid:%d] over capacity, hand back mission", mission.Rid))
+			returnMission(mission.Rid)
+			continue
+		}
+		journalMission(mission)
+		acceptMission(mission)
+	}
+	for _, command := range responseModel.Commands {
+		handleCommand(command)
 	}
+	return true
 }
 
-var syncLock sync.Mutex
+// fetchMissionAndSendStatus exchanges statuses for missions, it reports whether the server answered
+func fetchMissionAndSendStatus() bool {
+	return exchange(context.Background(), transport.PushStatus, true, true)
+}
 
-func SyncTestCase(pid int64) {
-	syncLock.Lock()
-	defer syncLock.Unlock()
-	if syncingPid[pid] || missions[pid] == false {
+// acceptMission queues the mission if the test data of its problem has been found up to date recently,
+// otherwise the mission is locked and the test data checked and updated off the exchange path
+func acceptMission(mission model.MissionModel) {
+	pid := mission.Pid
+	interval := time.Duration(config.GlobalConfig.Sync.CheckInterval) * time.Second
+	lockedMissionLock.Lock()
+	defer lockedMissionLock.Unlock()
+	updating := testCaseChecking[pid] || testcase.Store.Updating(pid)
+	if !updating && len(lockedMission[pid]) == 0 && time.Since(testCaseChecked[pid]) < interval {
+		appendMissions(mission)
 		return
 	}
-	syncingPid[pid] = true
+	lockedMission[pid] = append(lockedMission[pid], mission)
+	LogNormal(pid, fmt.Sprintf("[Rid:%d] wait for test case check", mission.Rid))
+	if !updating {
+		testCaseChecking[pid] = true
+		go checkLockedMissions(pid)
+	}
+}
 
-	go SyncTestCaseWithPid(pid, func() {
-		lockedMissionLock.Lock()
-		missionLock.Lock()
-		for _, mission := range lockedMission[pid] {
-			missionList = append(missionList, mission)
+// checkLockedMissions checks the test data of the problem, the locked missions are queued once it is
+// up to date, either right away or after the update, and fail if it can't be checked or updated
+func checkLockedMissions(pid int64) {
+	var plan *testCasePlan
+	var localVersion string
+	err := withRetry(pid, "check test case", func() error {
+		var err error
+		plan, localVersion, err = checkTestCase(pid)
+		return err
+	})
+	upToDate := err == nil && !plan.needSync(localVersion)
+	if err == nil && !upToDate {
+		// the store is updating from here, so that missions arriving meanwhile wait for the update
+		requestTestCaseUpdate(pid)
+	}
+	lockedMissionLock.Lock()
+	delete(testCaseChecking, pid)
+	lockedMissionLock.Unlock()
+	if err != nil {
+		failLockedMissions(pid, "check test case fail: "+err.Error())
+	} else if upToDate {
+		releaseLockedMissions(pid)
+	}
+}
+
+// requestTestCaseUpdate updates the test data of the problem once no run reads it, the locked missions
+// are queued or failed afterwards
+func requestTestCaseUpdate(pid int64) {
+	testcase.Store.RequestUpdate(pid, func() (string, error) {
+		return updateTestCase(pid)
+	}, func(err error) {
+		if err != nil {
+			failLockedMissions(pid, "sync test case fail: "+err.Error())
+			return
 		}
-		lockedMission[pid] = lockedMission[pid][0:0]
-		missionLock.Unlock()
-		lockedMissionLock.Unlock()
-		syncLock.Lock()
-		syncingPid[pid] = true
-		syncLock.Unlock()
+		releaseLockedMissions(pid)
 	})
 }
 
-func StartNetworkModule() {
-	for i := 0; ; i++ {
+// releaseLockedMissions queues the missions waiting for the test data of the problem, which is up to date
+func releaseLockedMissions(pid int64) {
+	lockedMissionLock.Lock()
+	testCaseChecked[pid] = time.Now()
+	appendMissions(lockedMission[pid]...)
+	lockedMission[pid] = nil
+	lockedMissionLock.Unlock()
+}
+
+// StartNetworkModule exchanges statuses and missions with the server until ctx is done
+func StartNetworkModule(ctx context.Context) {
+	if transport.Streaming() {
+		startStreaming(ctx)
+		return
+	}
+	for {
 		fetchMissionAndSendStatus()
-		time.Sleep(time.Second)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// startStreaming keeps a mission request pending on the server, and pushes statuses as soon as they are sent
+func startStreaming(ctx context.Context) {
+	fetchDone := make(chan struct{})
+	go func() {
+		defer close(fetchDone)
+		for ctx.Err() == nil {
+			if !exchange(ctx, transport.FetchMissions, false, true) {
+				select {
+				case <-ctx.Done():
+				case <-time.After(time.Second):
+				}
+			}
+		}
+	}()
+	for {
+		pending := pendingSignal()
+		if pendingCount() > 0 && exchange(ctx, transport.PushStatus, true, false) {
+			continue
+		}
+		var retry <-chan time.Time
+		if pendingCount() > 0 {
+			retry = time.After(time.Second)
+		}
+		select {
+		case <-ctx.Done():
+			<-fetchDone
+			return
+		case <-pending:
+		case <-retry:
+		}
 	}
 }
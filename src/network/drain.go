@@ -0,0 +1,76 @@
+package network
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"utils"
+)
+
+var draining bool
+var returnedRids []int64
+var returnedLock sync.Mutex
+
+func isDraining() bool {
+	returnedLock.Lock()
+	defer returnedLock.Unlock()
+	return draining
+}
+
+func returnMission(rid int64) {
+	returnedLock.Lock()
+	returnedRids = append(returnedRids, rid)
+	returnedLock.Unlock()
+	notifyPending()
+}
+
+// StartDraining stops accepting missions, missions sent by the server from now on are handed back
+func StartDraining() {
+	returnedLock.Lock()
+	draining = true
+	returnedLock.Unlock()
+	utils.Log(utils.LogTypeNormal, "start draining")
+}
+
+// ReturnQueuedMissions hands back every mission not dispatched to a worker yet
+func ReturnQueuedMissions() {
+	missionLock.Lock()
+	queued := takeAllMissions()
+	missionLock.Unlock()
+	lockedMissionLock.Lock()
+	for pid, missions := range lockedMission {
+		queued = append(queued, missions...)
+		lockedMission[pid] = nil
+	}
+	lockedMissionLock.Unlock()
+	for _, mission := range queued {
+		LogNormal(mission.Pid, fmt.Sprintf("[Rid:%d] hand back queued mission", mission.Rid))
+		returnMission(mission.Rid)
+	}
+}
+
+func pendingCount() int {
+	statusLock.Lock()
+	count := len(statusList)
+	statusLock.Unlock()
+	returnedLock.Lock()
+	count += len(returnedRids)
+	returnedLock.Unlock()
+	return count
+}
+
+// Flush sends pending statuses and handed back missions until nothing is left or the deadline passes,
+// the network module must be stopped before
+func Flush(deadline time.Time) bool {
+	for pendingCount() > 0 {
+		if time.Now().After(deadline) {
+			utils.Log(utils.LogTypeError, fmt.Sprintf("flush timeout, %d pending status(es) and mission(s) lost", pendingCount()))
+			return false
+		}
+		if !fetchMissionAndSendStatus() {
+			time.Sleep(time.Second)
+		}
+	}
+	utils.Log(utils.LogTypeNormal, "flush complete")
+	return true
+}
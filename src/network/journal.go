@@ -0,0 +1,308 @@
+package network
+
+import (
+	"bufio"
+	"config"
+	"encoding/json"
+	"fmt"
+	"model"
+	"os"
+	"sync"
+	"utils"
+)
+
+type journalEntryType string
+
+const (
+	// journalEntryMission is written when a mission is accepted from the server
+	journalEntryMission journalEntryType = "mission"
+	// journalEntryStatus is written when a status is queued for sending
+	journalEntryStatus journalEntryType = "status"
+	// journalEntryAck is written when the server received statuses
+	journalEntryAck journalEntryType = "ack"
+	// journalEntryReturn is written when the server received handed back missions
+	journalEntryReturn journalEntryType = "return"
+	// journalEntryCancel is written when the server cancelled a mission
+	journalEntryCancel journalEntryType = "cancel"
+)
+
+// journalEntry is a line of the append-only journal
+type journalEntry struct {
+	Type    journalEntryType    `json:"type"`
+	Mission *model.MissionModel `json:"mission,omitempty"`
+	Status  *model.StatusModel  `json:"status,omitempty"`
+	Seqs    []int64             `json:"seqs,omitempty"`
+	Rids    []int64             `json:"rids,omitempty"`
+}
+
+var journalFile *os.File
+var journalLock sync.Mutex
+
+// journalCond signals the end of a sync, entries are numbered as written and synced in groups,
+// so that concurrent writers share one fsync
+var journalCond = sync.NewCond(&journalLock)
+var journalWritten, journalSynced int64
+var journalSyncing bool
+
+// journalFinished counts the missions finished since the journal was compacted
+var journalFinished int
+
+func journalPath() string {
+	if path := config.GlobalConfig.Path.Journal; path != "" {
+		return path
+	}
+	return config.GlobalConfig.Path.Work + "judger.journal"
+}
+
+// appendJournal writes the entry without syncing it and returns its number for syncJournal,
+// it is cheap enough to be called with statusLock held
+func appendJournal(entry journalEntry) int64 {
+	journalLock.Lock()
+	defer journalLock.Unlock()
+	if journalFile == nil {
+		return 0
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return 0
+	}
+	if _, err := journalFile.Write(append(data, '\n')); err != nil {
+		utils.Log(utils.LogTypeError, "write journal fail: "+err.Error())
+		return 0
+	}
+	switch entry.Type {
+	case journalEntryStatus:
+		if entry.Status.Status.IsFinished() {
+			journalFinished++
+		}
+	case journalEntryReturn, journalEntryCancel:
+		journalFinished += len(entry.Rids)
+	}
+	journalWritten++
+	return journalWritten
+}
+
+// syncJournal waits until the entry is on disk, the first waiter syncs every entry written so far
+// while the others wait for it, the journal is compacted once enough missions are finished
+func syncJournal(number int64) {
+	journalLock.Lock()
+	defer journalLock.Unlock()
+	for journalSynced < number {
+		if journalSyncing {
+			journalCond.Wait()
+			continue
+		}
+		journalSyncing = true
+		file, target := journalFile, journalWritten
+		journalLock.Unlock()
+		err := file.Sync()
+		journalLock.Lock()
+		journalSyncing = false
+		if err != nil {
+			utils.Log(utils.LogTypeError, "sync journal fail: "+err.Error())
+		}
+		if target > journalSynced {
+			journalSynced = target
+		}
+		journalCond.Broadcast()
+	}
+	threshold := config.GlobalConfig.Path.JournalCompaction
+	if threshold > 0 && journalFinished >= threshold && !journalSyncing && journalFile != nil {
+		compactJournalLocked()
+	}
+}
+
+// writeJournal appends the entry and syncs it to disk before the caller goes on
+func writeJournal(entry journalEntry) {
+	syncJournal(appendJournal(entry))
+}
+
+func journalMission(mission model.MissionModel) {
+	writeJournal(journalEntry{Type: journalEntryMission, Mission: &mission})
+}
+
+// journalStatus appends the status, the caller syncs the returned number once statusLock is released
+func journalStatus(status model.StatusModel) int64 {
+	return appendJournal(journalEntry{Type: journalEntryStatus, Status: &status})
+}
+
+// journalAck appends the acknowledgement, the caller syncs the returned number once statusLock is released
+func journalAck(statuses []model.StatusModel) int64 {
+	if len(statuses) == 0 {
+		return 0
+	}
+	seqs := make([]int64, 0, len(statuses))
+	for _, status := range statuses {
+		seqs = append(seqs, status.Seq)
+	}
+	return appendJournal(journalEntry{Type: journalEntryAck, Seqs: seqs})
+}
+
+func journalCancel(rid int64) {
+	writeJournal(journalEntry{Type: journalEntryCancel, Rids: []int64{rid}})
+}
+
+func journalReturn(rids []int64) {
+	if len(rids) == 0 {
+		return
+	}
+	writeJournal(journalEntry{Type: journalEntryReturn, Rids: rids})
+}
+
+// replayJournal collects the missions without a final status and the statuses never acknowledged
+func replayJournal(path string) ([]model.MissionModel, []model.StatusModel, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	var missionOrder []int64
+	missions := map[int64]model.MissionModel{}
+	var statusOrder []int64
+	statuses := map[int64]model.StatusModel{}
+	finished := map[int64]bool{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// the last line may be torn by a crash
+			utils.Log(utils.LogTypeWarning, "skip broken journal entry")
+			continue
+		}
+		switch entry.Type {
+		case journalEntryMission:
+			if entry.Mission != nil {
+				if _, ok := missions[entry.Mission.Rid]; !ok {
+					missionOrder = append(missionOrder, entry.Mission.Rid)
+				}
+				missions[entry.Mission.Rid] = *entry.Mission
+				delete(finished, entry.Mission.Rid)
+			}
+		case journalEntryStatus:
+			if entry.Status != nil {
+				statusOrder = append(statusOrder, entry.Status.Seq)
+				statuses[entry.Status.Seq] = *entry.Status
+				if entry.Status.Status.IsFinished() {
+					finished[entry.Status.Rid] = true
+				}
+			}
+		case journalEntryAck:
+			for _, seq := range entry.Seqs {
+				delete(statuses, seq)
+			}
+		case journalEntryReturn, journalEntryCancel:
+			for _, rid := range entry.Rids {
+				finished[rid] = true
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	var pendingMissions []model.MissionModel
+	for _, rid := range missionOrder {
+		if !finished[rid] {
+			pendingMissions = append(pendingMissions, missions[rid])
+		}
+	}
+	var pendingStatuses []model.StatusModel
+	for _, seq := range statusOrder {
+		if status, ok := statuses[seq]; ok {
+			pendingStatuses = append(pendingStatuses, status)
+		}
+	}
+	return pendingMissions, pendingStatuses, nil
+}
+
+// compactJournal rewrites the journal with the pending entries only, and opens it for appending
+func compactJournal(path string, missions []model.MissionModel, statuses []model.StatusModel) error {
+	tempPath := path + ".tmp"
+	file, err := os.OpenFile(tempPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for i := range missions {
+		if err := encoder.Encode(journalEntry{Type: journalEntryMission, Mission: &missions[i]}); err != nil {
+			_ = file.Close()
+			return err
+		}
+	}
+	for i := range statuses {
+		if err := encoder.Encode(journalEntry{Type: journalEntryStatus, Status: &statuses[i]}); err != nil {
+			_ = file.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		return err
+	}
+	if journalFile != nil {
+		_ = journalFile.Close()
+	}
+	journalFile, err = os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	// everything written before is part of the compacted journal, which is synced
+	journalSynced, journalFinished = journalWritten, 0
+	return err
+}
+
+// compactJournalLocked compacts the journal of a running judger, no sync may be running, journalLock must be held
+func compactJournalLocked() {
+	path := journalPath()
+	missions, statuses, err := replayJournal(path)
+	if err == nil {
+		err = compactJournal(path, missions, statuses)
+	}
+	if err != nil {
+		utils.Log(utils.LogTypeError, "compact journal fail: "+err.Error())
+		journalFinished = 0
+		return
+	}
+	utils.Log(utils.LogTypeNormal, fmt.Sprintf("compact journal to %d mission(s) and %d status(es)", len(missions), len(statuses)))
+}
+
+// RecoverJournal requeues the missions and statuses left by the last run, it must be called before
+// the network module starts
+func RecoverJournal() {
+	path := journalPath()
+	missions, statuses, err := replayJournal(path)
+	if err != nil {
+		panic(fmt.Sprintf("read journal %s fail: %s", path, err.Error()))
+	}
+	journalLock.Lock()
+	err = compactJournal(path, missions, statuses)
+	journalLock.Unlock()
+	if err != nil {
+		panic(fmt.Sprintf("compact journal %s fail: %s", path, err.Error()))
+	}
+	statusLock.Lock()
+	for _, status := range statuses {
+		if status.Seq > statusSeq {
+			statusSeq = status.Seq
+		}
+	}
+	statusList = append(statusList, statuses...)
+	statusLock.Unlock()
+	utils.Log(utils.LogTypeNormal, fmt.Sprintf("recover %d mission(s) and %d status(es) from journal", len(missions), len(statuses)))
+	for _, mission := range missions {
+		acceptMission(mission)
+	}
+}
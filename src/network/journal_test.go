@@ -0,0 +1,133 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"model"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReplayJournal(t *testing.T) {
+	first := model.MissionModel{Rid: 1, Pid: 10, Queue: model.QueueClassContest}
+	second := model.MissionModel{Rid: 2, Pid: 20, Queue: model.QueueClassPractice}
+	rejudged := model.MissionModel{Rid: 1, Pid: 10, Queue: model.QueueClassRejudge}
+	running := model.StatusModel{Seq: 100, Rid: 1, Pid: 10, Status: model.JudgeStatusRunning}
+	accepted := model.StatusModel{Seq: 101, Rid: 1, Pid: 10, Status: model.JudgeStatusAccept}
+	line := func(entry journalEntry) string {
+		data, _ := json.Marshal(entry)
+		return string(data)
+	}
+	mission := func(mission model.MissionModel) string {
+		return line(journalEntry{Type: journalEntryMission, Mission: &mission})
+	}
+	status := func(status model.StatusModel) string {
+		return line(journalEntry{Type: journalEntryStatus, Status: &status})
+	}
+	torn := mission(second)
+	tests := []struct {
+		name     string
+		lines    []string
+		missions []model.MissionModel
+		statuses []model.StatusModel
+	}{
+		{
+			name:     "missions in order",
+			lines:    []string{mission(first), mission(second)},
+			missions: []model.MissionModel{first, second},
+		},
+		{
+			name:     "torn last line",
+			lines:    []string{mission(first), torn[:len(torn)/2]},
+			missions: []model.MissionModel{first},
+		},
+		{
+			name:     "broken line in the middle",
+			lines:    []string{mission(first), "{\"type\":", mission(second)},
+			missions: []model.MissionModel{first, second},
+		},
+		{
+			name:     "unacknowledged statuses",
+			lines:    []string{mission(first), status(running)},
+			missions: []model.MissionModel{first},
+			statuses: []model.StatusModel{running},
+		},
+		{
+			name:     "final status finishes the mission",
+			lines:    []string{mission(first), status(running), status(accepted)},
+			statuses: []model.StatusModel{running, accepted},
+		},
+		{
+			name: "acknowledged statuses",
+			lines: []string{
+				mission(first),
+				status(running),
+				status(accepted),
+				line(journalEntry{Type: journalEntryAck, Seqs: []int64{running.Seq, accepted.Seq}}),
+			},
+		},
+		{
+			name: "cancelled mission",
+			lines: []string{
+				mission(first),
+				mission(second),
+				line(journalEntry{Type: journalEntryCancel, Rids: []int64{first.Rid}}),
+			},
+			missions: []model.MissionModel{second},
+		},
+		{
+			name: "returned missions",
+			lines: []string{
+				mission(first),
+				mission(second),
+				line(journalEntry{Type: journalEntryReturn, Rids: []int64{first.Rid, second.Rid}}),
+			},
+		},
+		{
+			name: "rejudge after the final status",
+			lines: []string{
+				mission(first),
+				status(accepted),
+				line(journalEntry{Type: journalEntryAck, Seqs: []int64{accepted.Seq}}),
+				mission(rejudged),
+			},
+			missions: []model.MissionModel{rejudged},
+		},
+	}
+	dir, err := ioutil.TempDir("", "journal-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(dir, fmt.Sprintf("judger.journal.%d", i))
+			if err := ioutil.WriteFile(path, []byte(strings.Join(test.lines, "\n")), 0644); err != nil {
+				t.Fatal(err)
+			}
+			missions, statuses, err := replayJournal(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(missions, test.missions) {
+				t.Errorf("missions %v, want %v", missions, test.missions)
+			}
+			if !reflect.DeepEqual(statuses, test.statuses) {
+				t.Errorf("statuses %v, want %v", statuses, test.statuses)
+			}
+		})
+	}
+}
+
+func TestReplayMissingJournal(t *testing.T) {
+	missions, statuses, err := replayJournal(filepath.Join(os.TempDir(), "no-such-judger.journal"))
+	if err != nil || missions != nil || statuses != nil {
+		t.Fatalf("replay of a missing journal = %v, %v, %v", missions, statuses, err)
+	}
+}
@@ -0,0 +1,106 @@
+package network
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testcase"
+)
+
+var testCaseFileRegex = regexp.MustCompile("^.+\\.(in|out)$")
+
+func hashFile(filePath string) (string, int64, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", 0, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+// localManifest describes the files in the testcase directory, the stored manifest is trusted for files
+// whose size still matches, other files are hashed, a missing directory has no files
+func localManifest(pid int64) (testcase.Manifest, error) {
+	dir := testcase.Dir(pid)
+	manifest := testcase.Manifest{}
+	stored := map[string]testcase.File{}
+	if storedManifest := testcase.ReadManifest(dir); storedManifest != nil {
+		manifest.Version = storedManifest.Version
+		for _, file := range storedManifest.Files {
+			stored[file.Name] = file
+		}
+	}
+	var names []string
+	testCases, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return manifest, nil
+	}
+	if err != nil {
+		return manifest, err
+	}
+	for _, file := range testCases {
+		if file.Mode().IsRegular() && testCaseFileRegex.MatchString(file.Name()) {
+			names = append(names, file.Name())
+		}
+	}
+	// grader files of function-signature problems are listed as grader/<filename>
+	graderFiles, _ := ioutil.ReadDir(filepath.Join(dir, graderDirectoryName))
+	for _, file := range graderFiles {
+		if file.Mode().IsRegular() {
+			names = append(names, graderDirectoryName+"/"+file.Name())
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			return manifest, err
+		}
+		if file, ok := stored[name]; ok && file.Size == info.Size() {
+			manifest.Files = append(manifest.Files, file)
+			continue
+		}
+		digest, size, err := hashFile(filepath.Join(dir, name))
+		if err != nil {
+			return manifest, err
+		}
+		manifest.Files = append(manifest.Files, testcase.File{Name: name, Size: size, SHA256: digest})
+	}
+	return manifest, nil
+}
+
+// diffManifest lists the files to download and the files to remove for the local data to match the remote
+func diffManifest(local testcase.Manifest, remote testcase.Manifest) ([]testcase.File, []string) {
+	localFiles := map[string]testcase.File{}
+	for _, file := range local.Files {
+		localFiles[file.Name] = file
+	}
+	remoteNames := map[string]bool{}
+	var downloads []testcase.File
+	for _, file := range remote.Files {
+		remoteNames[file.Name] = true
+		if localFile, ok := localFiles[file.Name]; !ok || localFile.Size != file.Size || !strings.EqualFold(localFile.SHA256, file.SHA256) {
+			downloads = append(downloads, file)
+		}
+	}
+	var removes []string
+	for _, file := range local.Files {
+		if !remoteNames[file.Name] {
+			removes = append(removes, file.Name)
+		}
+	}
+	return downloads, removes
+}
@@ -0,0 +1,71 @@
+package network
+
+import (
+	"reflect"
+	"testcase"
+	"testing"
+)
+
+func TestDiffManifest(t *testing.T) {
+	input := testcase.File{Name: "1.in", Size: 4, SHA256: "aa"}
+	output := testcase.File{Name: "1.out", Size: 2, SHA256: "bb"}
+	tests := []struct {
+		name      string
+		local     []testcase.File
+		remote    []testcase.File
+		downloads []testcase.File
+		removes   []string
+	}{
+		{
+			name:      "nothing local",
+			remote:    []testcase.File{input, output},
+			downloads: []testcase.File{input, output},
+		},
+		{
+			name:   "up to date",
+			local:  []testcase.File{input, output},
+			remote: []testcase.File{input, output},
+		},
+		{
+			name:   "sha256 case differs",
+			local:  []testcase.File{{Name: "1.in", Size: 4, SHA256: "AA"}},
+			remote: []testcase.File{input},
+		},
+		{
+			name:      "size changed",
+			local:     []testcase.File{{Name: "1.in", Size: 5, SHA256: "aa"}, output},
+			remote:    []testcase.File{input, output},
+			downloads: []testcase.File{input},
+		},
+		{
+			name:      "sha256 changed",
+			local:     []testcase.File{input, {Name: "1.out", Size: 2, SHA256: "cc"}},
+			remote:    []testcase.File{input, output},
+			downloads: []testcase.File{output},
+		},
+		{
+			name:    "file removed",
+			local:   []testcase.File{input, output},
+			remote:  []testcase.File{input},
+			removes: []string{"1.out"},
+		},
+		{
+			name:      "file renamed",
+			local:     []testcase.File{input},
+			remote:    []testcase.File{{Name: "2.in", Size: 4, SHA256: "aa"}},
+			downloads: []testcase.File{{Name: "2.in", Size: 4, SHA256: "aa"}},
+			removes:   []string{"1.in"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			downloads, removes := diffManifest(testcase.Manifest{Files: test.local}, testcase.Manifest{Files: test.remote})
+			if !reflect.DeepEqual(downloads, test.downloads) {
+				t.Errorf("downloads %v, want %v", downloads, test.downloads)
+			}
+			if !reflect.DeepEqual(removes, test.removes) {
+				t.Errorf("removes %v, want %v", removes, test.removes)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package network
+
+import (
+	"config"
+	"model"
+)
+
+// missionQueue holds the missions of a queue class, highest priority first and FIFO within a priority
+type missionQueue struct {
+	missions []model.MissionModel
+	weight   int
+	// current is the running weight of the smooth weighted round robin
+	current int
+}
+
+var missionQueues map[model.QueueClass]*missionQueue
+
+// queueClasses fixes the order queues are visited in, so that ties go to the more urgent class
+var queueClasses = []model.QueueClass{model.QueueClassContest, model.QueueClassPractice, model.QueueClassRejudge}
+
+func initMissionQueues() {
+	queueConfig := config.GlobalConfig.Queue
+	missionQueues = map[model.QueueClass]*missionQueue{
+		model.QueueClassContest:  {weight: queueConfig.ContestWeight},
+		model.QueueClassPractice: {weight: queueConfig.PracticeWeight},
+		model.QueueClassRejudge:  {weight: queueConfig.RejudgeWeight},
+	}
+	for _, queue := range missionQueues {
+		if queue.weight <= 0 {
+			queue.weight = 1
+		}
+	}
+}
+
+// IsHighPriority reports whether the mission may run in a reserved slot
+func IsHighPriority(mission model.MissionModel) bool {
+	return mission.Priority >= config.GlobalConfig.Queue.HighPriority
+}
+
+func queueOf(mission model.MissionModel) *missionQueue {
+	if queue, ok := missionQueues[mission.Queue]; ok {
+		return queue
+	}
+	return missionQueues[model.QueueClassPractice]
+}
+
+// pushMission inserts the mission after every mission of the same or higher priority, missionLock must be held
+func pushMission(mission model.MissionModel) {
+	queue := queueOf(mission)
+	i := len(queue.missions)
+	for i > 0 && queue.missions[i-1].Priority < mission.Priority {
+		i--
+	}
+	queue.missions = append(queue.missions, model.MissionModel{})
+	copy(queue.missions[i+1:], queue.missions[i:])
+	queue.missions[i] = mission
+}
+
+// selectMission picks the queue by smooth weighted round robin and takes its head, missionLock must be held
+func selectMission(highPriorityOnly bool) *model.MissionModel {
+	var selected *missionQueue
+	total := 0
+	for _, class := range queueClasses {
+		queue := missionQueues[class]
+		if len(queue.missions) == 0 || (highPriorityOnly && !IsHighPriority(queue.missions[0])) {
+			continue
+		}
+		queue.current += queue.weight
+		total += queue.weight
+		if selected == nil || queue.current > selected.current {
+			selected = queue
+		}
+	}
+	if selected == nil {
+		return nil
+	}
+	selected.current -= total
+	mission := selected.missions[0]
+	selected.missions = selected.missions[1:]
+	return &mission
+}
+
+// removeMission removes the mission with rid from its queue, missionLock must be held
+func removeMission(rid int64) (model.MissionModel, bool) {
+	for _, queue := range missionQueues {
+		for i, mission := range queue.missions {
+			if mission.Rid == rid {
+				queue.missions = append(queue.missions[:i:i], queue.missions[i+1:]...)
+				return mission, true
+			}
+		}
+	}
+	return model.MissionModel{}, false
+}
+
+// takeAllMissions empties every queue, missionLock must be held
+func takeAllMissions() []model.MissionModel {
+	var missions []model.MissionModel
+	for _, class := range queueClasses {
+		queue := missionQueues[class]
+		missions = append(missions, queue.missions...)
+		queue.missions = nil
+	}
+	return missions
+}
+
+// queuedMissionCount counts the missions of every queue, missionLock must be held
+func queuedMissionCount() int {
+	count := 0
+	for _, queue := range missionQueues {
+		count += len(queue.missions)
+	}
+	return count
+}
@@ -1,134 +1,129 @@
 package network
 
 import (
-	"bytes"
 	"config"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"io/ioutil"
-	"net/http"
-	"os"
-	"regexp"
-	"strconv"
-	"syscall"
+	"math/rand"
+	"testcase"
 	"time"
 )
 
-var downloadURL, checkURL string
-var missions map[int64]bool
-
-func init() {
-	missions = map[int64]bool{}
-	serverConfig := config.GlobalConfig.Server
-	downloadURL = fmt.Sprintf("http://%s:%s/downloadTestCase/", serverConfig.Host, serverConfig.Port)
-	checkURL = fmt.Sprintf("http://%s:%s/checkTestCase/", serverConfig.Host, serverConfig.Port)
-}
+// graderDirectoryName matches the directory machines copy grader files from
+const graderDirectoryName = "grader"
 
+// syncTestCaseRequestModel sends the manifest of the local test data
 type syncTestCaseRequestModel struct {
-	Filenames []string `json:"filenames"`
-	Pid       int64    `json:"pid"`
+	Pid     int64           `json:"pid"`
+	Version string          `json:"version"`
+	Files   []testcase.File `json:"files"`
 }
 
+// syncTestCaseResponseModel is the manifest of the test data on the server
 type syncTestCaseResponseModel struct {
-	Filenames       []string `json:"filenames"`
-	RemoveFilenames []string `json:"remove_filenames"`
+	Version string          `json:"version"`
+	Files   []testcase.File `json:"files"`
 }
 
-func CheckTestCaseWithPid(pid int64) (bool, *syncTestCaseResponseModel) {
-	LogNormal(pid, "start check test case")
-	if missions[pid] {
-		return false, nil
-	}
-	defer func() {
-		LogNormal(pid, fmt.Sprintf("[NeedSync:%v] check test case complete", missions[pid]))
-	}()
-	client := http.Client{Timeout: 30 * time.Second}
-	testCases, err := ioutil.ReadDir(config.GlobalConfig.Path.Data + strconv.FormatInt(pid, 10))
+// testCasePlan is what a synchronization has to do for the local test data to match the server
+type testCasePlan struct {
+	manifest  testcase.Manifest
+	downloads []testcase.File
+	removes   []string
+}
+
+func (p *testCasePlan) needSync(localVersion string) bool {
+	return len(p.downloads) > 0 || len(p.removes) > 0 || p.manifest.Version != localVersion
+}
+
+// checkTestCase exchanges manifests with the server, it returns the plan and the local data version
+func checkTestCase(pid int64) (*testCasePlan, string, error) {
+	local, err := localManifest(pid)
 	if err != nil {
 		LogError(pid, "open testcase directory fail")
-		return false, nil
+		return nil, "", err
 	}
 	requestModel := syncTestCaseRequestModel{
-		Pid: pid,
-	}
-	inputFileRegex := regexp.MustCompile("^.+\\.in$")
-	outputFileRegex := regexp.MustCompile("^.+\\.out$")
-	for _, file := range testCases {
-		if inputFileRegex.MatchString(file.Name()) || outputFileRegex.MatchString(file.Name()) {
-			requestModel.Filenames = append(requestModel.Filenames, file.Name())
-		}
+		Pid:     pid,
+		Version: local.Version,
+		Files:   local.Files,
 	}
-	data, err := json.Marshal(requestModel)
+	responseModel, err := transport.CheckTestCase(context.Background(), requestModel)
 	if err != nil {
-		return false, nil
+		if errors.Is(err, errBadSignature) {
+			LogError(pid, "reject check test case response: "+err.Error())
+		}
+		return nil, "", err
 	}
-	if response, err := client.Post(checkURL, "application/json", bytes.NewBuffer(data)); err == nil {
-		if body, err := ioutil.ReadAll(response.Body); err == nil {
-			responseModel := syncTestCaseResponseModel{}
-			if err := json.Unmarshal(body, &responseModel); err == nil {
-				if len(responseModel.Filenames) > 0 || len(responseModel.RemoveFilenames) > 0 {
-					missions[pid] = true
-					return true, &responseModel
-				}
-				return false, nil
-			}
+	for _, file := range responseModel.Files {
+		if !testcase.IsSafeName(file.Name) {
+			LogError(pid, fmt.Sprintf("[filename:%s] reject unsafe test case name", file.Name))
+			return nil, "", fmt.Errorf("unsafe test case name %q", file.Name)
 		}
 	}
-	return false, nil
+	remote := testcase.Manifest{Version: responseModel.Version, Files: responseModel.Files}
+	downloads, removes := diffManifest(local, remote)
+	return &testCasePlan{manifest: remote, downloads: downloads, removes: removes}, local.Version, nil
 }
 
-func SyncTestCaseWithPid(pid int64, callback func()) {
-	if missions[pid] == false {
-		callback()
-		return
+// retryDelay is the exponential backoff before the next attempt, with up to half of it randomized
+// so that judgers don't retry in lockstep
+func retryDelay(attempt int) time.Duration {
+	syncConfig := config.GlobalConfig.Sync
+	delay := time.Duration(syncConfig.RetryDelay) * time.Second
+	maxDelay := time.Duration(syncConfig.MaxRetryDelay) * time.Second
+	for i := 1; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
 	}
-	LogNormal(pid, "start sync test case")
-	if needSync, model := CheckTestCaseWithPid(pid); needSync == true {
-		if err := syscall.Access(fmt.Sprintf("%s%d", config.GlobalConfig.Path.Data, pid), 0); err != nil {
-			if err := os.MkdirAll(fmt.Sprintf("%s%d", config.GlobalConfig.Path.Data, pid), os.ModePerm); err != nil {
-				time.Sleep(30 * time.Second)
-				LogError(pid, fmt.Sprintf("create directory fail, retry after 30 senonds"))
-				SyncTestCaseWithPid(pid, callback)
-				return
-			}
-		}
-		for _, filename := range model.Filenames {
-			LogNormal(pid, "download "+filename)
-			response, err := http.Get(fmt.Sprintf("%s?pid=%d&filename=%s", downloadURL, pid, filename))
-			if err != nil || response.StatusCode == 404 {
-				time.Sleep(30 * time.Second)
-				LogWarning(pid, fmt.Sprintf("[filename:%s] download fail, retry after 30 senonds", filename))
-				SyncTestCaseWithPid(pid, callback)
-				return
-			}
-			data, err := ioutil.ReadAll(response.Body)
-			if err != nil {
-				time.Sleep(30 * time.Second)
-				LogWarning(pid, fmt.Sprintf("[filename:%s] download fail, retry after 30 senonds", filename))
-				SyncTestCaseWithPid(pid, callback)
-				return
-			}
-			savePath := fmt.Sprintf("%s%d/%s", config.GlobalConfig.Path.Data, pid, filename)
-			err = ioutil.WriteFile(savePath, data, os.ModePerm)
-			if err != nil {
-				LogError(pid, fmt.Sprintf("[filename:%s] save fail, retry after 30 senonds", filename))
-				time.Sleep(30 * time.Second)
-				SyncTestCaseWithPid(pid, callback)
-				return
-			}
-			LogNormal(pid, "download "+filename+"complete")
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// withRetry runs action until it succeeds or the attempts run out, the last error is returned
+func withRetry(pid int64, description string, action func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = action(); err == nil {
+			return nil
 		}
-		for _, filename := range model.RemoveFilenames {
-			removePath := fmt.Sprintf("%s%d/%s", config.GlobalConfig.Path.Data, pid, filename)
-			if err := os.Remove(removePath); err != nil {
-				time.Sleep(30 * time.Second)
-				LogWarning(pid, fmt.Sprintf("[filename:%s] remove fail, retry after 30 senonds", filename))
-				SyncTestCaseWithPid(pid, callback)
-				return
-			}
+		if attempt >= config.GlobalConfig.Sync.MaxAttempts {
+			LogError(pid, fmt.Sprintf("%s fail after %d attempt(s): %s", description, attempt, err.Error()))
+			return err
 		}
-		LogNormal(pid, "sync test case complete")
-		callback()
+		delay := retryDelay(attempt)
+		LogWarning(pid, fmt.Sprintf("%s fail: %s, retry after %s", description, err.Error(), delay))
+		time.Sleep(delay)
+	}
+}
+
+// updateTestCase builds a new version of the test data of the problem for the store to switch to,
+// an empty directory is returned if the test data is up to date
+func updateTestCase(pid int64) (string, error) {
+	LogNormal(pid, "start sync test case")
+	var plan *testCasePlan
+	var localVersion string
+	err := withRetry(pid, "check test case", func() error {
+		var err error
+		plan, localVersion, err = checkTestCase(pid)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	if !plan.needSync(localVersion) {
+		LogNormal(pid, "test case up to date")
+		return "", nil
+	}
+	versionDir, err := buildTestCaseVersion(pid, plan)
+	if err != nil {
+		return "", err
 	}
-	return
+	LogNormal(pid, "sync test case complete")
+	return versionDir, nil
 }
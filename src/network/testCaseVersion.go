@@ -0,0 +1,145 @@
+package network
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testcase"
+	"time"
+)
+
+// writeFileAtomically streams reader into a temp file beside the target, syncs and verifies it,
+// then renames it into place
+func writeFileAtomically(target string, reader io.Reader, file testcase.File) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	temp, err := ioutil.TempFile(filepath.Dir(target), ".download-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(temp.Name())
+	}()
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(temp, hash), reader)
+	if err == nil {
+		err = temp.Chmod(0644)
+	}
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if size != file.Size || !strings.EqualFold(hex.EncodeToString(hash.Sum(nil)), file.SHA256) {
+		return errors.New("size or sha256 mismatch")
+	}
+	return os.Rename(temp.Name(), target)
+}
+
+// downloadTestCaseFile streams the file into the staging directory
+func downloadTestCaseFile(pid int64, file testcase.File, stagingDir string) error {
+	body, err := transport.DownloadTestCase(context.Background(), pid, file.Name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = body.Close()
+	}()
+	err = writeFileAtomically(filepath.Join(stagingDir, file.Name), body, file)
+	if errors.Is(err, errBadSignature) {
+		LogError(pid, fmt.Sprintf("[filename:%s] reject download: %s", file.Name, err.Error()))
+	}
+	return err
+}
+
+// reuseTestCaseFile hard links an unchanged file of the current version into the staging directory,
+// falling back to a copy across file systems
+func reuseTestCaseFile(currentDir string, file testcase.File, stagingDir string) error {
+	source := filepath.Join(currentDir, file.Name)
+	target := filepath.Join(stagingDir, file.Name)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if _, err := os.Lstat(target); err == nil {
+		return nil
+	}
+	if err := os.Link(source, target); err == nil {
+		return nil
+	}
+	reader, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+	return writeFileAtomically(target, reader, file)
+}
+
+// buildTestCaseVersion builds a version directory from the plan, reusing unchanged files of the current
+// version and downloading the others, every step is retried on its own. The store switches to the version
+// once it is built
+func buildTestCaseVersion(pid int64, plan *testCasePlan) (string, error) {
+	if err := os.MkdirAll(testcase.VersionsDir(pid), 0755); err != nil {
+		return "", err
+	}
+	stagingDir, err := ioutil.TempDir(testcase.VersionsDir(pid), ".staging-")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = os.RemoveAll(stagingDir)
+	}()
+	currentDir, _ := filepath.EvalSymlinks(testcase.Dir(pid))
+	downloads := map[string]bool{}
+	for _, file := range plan.downloads {
+		downloads[file.Name] = true
+	}
+	for _, file := range plan.manifest.Files {
+		if downloads[file.Name] {
+			continue
+		}
+		err := withRetry(pid, fmt.Sprintf("[filename:%s] reuse", file.Name), func() error {
+			return reuseTestCaseFile(currentDir, file, stagingDir)
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	for _, file := range downloadBundleIfWorth(pid, plan.downloads, stagingDir) {
+		LogNormal(pid, "download "+file.Name)
+		err := withRetry(pid, fmt.Sprintf("[filename:%s] download", file.Name), func() error {
+			return downloadTestCaseFile(pid, file, stagingDir)
+		})
+		if err != nil {
+			return "", err
+		}
+		LogNormal(pid, "download "+file.Name+" complete")
+	}
+	for _, filename := range plan.removes {
+		LogNormal(pid, "drop "+filename)
+	}
+	if err := testcase.WriteManifest(stagingDir, plan.manifest); err != nil {
+		return "", err
+	}
+	if err := testcase.SyncDirectory(stagingDir); err != nil {
+		return "", err
+	}
+	versionDir := filepath.Join(testcase.VersionsDir(pid), fmt.Sprint(time.Now().UnixNano()))
+	if err := os.Rename(stagingDir, versionDir); err != nil {
+		return "", err
+	}
+	return versionDir, nil
+}
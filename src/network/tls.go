@@ -0,0 +1,67 @@
+package network
+
+import (
+	"config"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// newTLSConfig builds the client side of https from the server config, any misconfiguration is an error
+func newTLSConfig(serverConfig config.Server) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: serverConfig.Host,
+		MinVersion: tls.VersionTLS12,
+	}
+	if serverConfig.CA != "" {
+		data, err := ioutil.ReadFile(serverConfig.CA)
+		if err != nil {
+			return nil, fmt.Errorf("read ca bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificate found in ca bundle %s", serverConfig.CA)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if (serverConfig.ClientCert == "") != (serverConfig.ClientKey == "") {
+		return nil, errors.New("client cert and client key must be set together")
+	}
+	if serverConfig.ClientCert != "" {
+		certificate, err := tls.LoadX509KeyPair(serverConfig.ClientCert, serverConfig.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	if serverConfig.Pins != "" {
+		pins := map[string]bool{}
+		for _, pin := range strings.Split(serverConfig.Pins, ",") {
+			pin = strings.TrimPrefix(strings.TrimSpace(pin), "sha256/")
+			digest, err := base64.StdEncoding.DecodeString(pin)
+			if err != nil || len(digest) != sha256.Size {
+				return nil, fmt.Errorf("pin %q isn't a base64 sha256 digest", pin)
+			}
+			pins[string(digest)] = true
+		}
+		// pinning comes on top of the chain verification, any certificate of a verified chain may match,
+		// so that roots and intermediates the server doesn't send can be pinned
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			for _, chain := range state.VerifiedChains {
+				for _, certificate := range chain {
+					digest := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+					if pins[string(digest[:])] {
+						return nil
+					}
+				}
+			}
+			return errors.New("no pinned public key in the verified server certificate chains")
+		}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,256 @@
+package network
+
+import (
+	"bytes"
+	"config"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+	"utils"
+)
+
+const (
+	TransportPoll     = "poll"
+	TransportLongPoll = "longpoll"
+)
+
+// Transport carries the exchange with the server
+type Transport interface {
+	// FetchMissions asks for missions and commands, a streaming transport holds the request
+	// until something arrives or ctx is done
+	FetchMissions(ctx context.Context, request MissionRequestModel) (*MissionResponseModel, error)
+	// PushStatus sends statuses and handed back missions, the answer acknowledges them
+	PushStatus(ctx context.Context, request MissionRequestModel) (*MissionResponseModel, error)
+	// CheckTestCase asks which test case files are outdated
+	CheckTestCase(ctx context.Context, request syncTestCaseRequestModel) (*syncTestCaseResponseModel, error)
+	// DownloadTestCase opens a test case file, the caller closes it
+	DownloadTestCase(ctx context.Context, pid int64, filename string) (io.ReadCloser, error)
+	// DownloadTestCaseBundle opens a tar.gz of the files, errBundleUnsupported if the server has no bundles
+	DownloadTestCaseBundle(ctx context.Context, pid int64, filenames []string) (io.ReadCloser, error)
+	// Streaming reports whether missions are fetched on their own, so statuses are pushed as soon as they are sent
+	Streaming() bool
+}
+
+var transport Transport
+
+func newTransport() Transport {
+	serverConfig := config.GlobalConfig.Server
+	var roundTripper http.RoundTripper = http.DefaultTransport
+	switch serverConfig.Scheme {
+	case "http":
+		if serverConfig.CA != "" || serverConfig.ClientCert != "" || serverConfig.Pins != "" {
+			panic("tls options are set but the server scheme is http")
+		}
+	case "https":
+		tlsConfig, err := newTLSConfig(serverConfig)
+		if err != nil {
+			panic("tls config: " + err.Error())
+		}
+		httpsTransport := http.DefaultTransport.(*http.Transport).Clone()
+		httpsTransport.TLSClientConfig = tlsConfig
+		roundTripper = httpsTransport
+	default:
+		panic(fmt.Sprintf("unknown server scheme %q", serverConfig.Scheme))
+	}
+	if serverConfig.Secret != "" {
+		roundTripper = newSigningTransport(roundTripper, serverConfig.Secret, time.Duration(serverConfig.SignatureWindow)*time.Second)
+	} else {
+		utils.Log(utils.LogTypeWarning, "no server secret configured, requests are not signed")
+	}
+	poller := &pollingTransport{
+		baseURL:     fmt.Sprintf("%s://%s:%s", serverConfig.Scheme, serverConfig.Host, serverConfig.Port),
+		client:      &http.Client{Transport: roundTripper, Timeout: 30 * time.Second},
+		idleTimeout: time.Duration(config.GlobalConfig.Sync.IdleTimeout) * time.Second,
+	}
+	switch serverConfig.Transport {
+	case TransportPoll:
+		return poller
+	case TransportLongPoll:
+		return &longPollTransport{
+			pollingTransport: poller,
+			wait:             time.Duration(serverConfig.LongPollWait) * time.Second,
+		}
+	default:
+		panic(fmt.Sprintf("unknown transport %q", serverConfig.Transport))
+	}
+}
+
+// pollingTransport exchanges statuses for missions in one request, sent once a second
+type pollingTransport struct {
+	baseURL string
+	client  *http.Client
+	// idleTimeout cancels downloads receiving no data for that long, 0 never cancels them
+	idleTimeout time.Duration
+}
+
+// idleBody is the body of a download, the request is cancelled once no data arrives for the timeout
+type idleBody struct {
+	body    io.ReadCloser
+	ctx     context.Context
+	cancel  context.CancelFunc
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if n > 0 {
+		b.timer.Reset(b.timeout)
+	}
+	if err != nil && err != io.EOF && b.ctx.Err() != nil {
+		err = fmt.Errorf("no data received for %s", b.timeout)
+	}
+	return n, err
+}
+
+func (b *idleBody) Close() error {
+	b.timer.Stop()
+	b.cancel()
+	return b.body.Close()
+}
+
+// postJSON posts the request model and decodes the response model
+func (t *pollingTransport) postJSON(ctx context.Context, client *http.Client, path string, requestModel interface{}, responseModel interface{}) error {
+	data, err := json.Marshal(requestModel)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, t.baseURL+path, bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", path, response.Status)
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, responseModel)
+}
+
+func (t *pollingTransport) FetchMissions(ctx context.Context, request MissionRequestModel) (*MissionResponseModel, error) {
+	return t.PushStatus(ctx, request)
+}
+
+func (t *pollingTransport) PushStatus(ctx context.Context, request MissionRequestModel) (*MissionResponseModel, error) {
+	var response MissionResponseModel
+	if err := t.postJSON(ctx, t.client, "/api/core/j2s/", request, &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+func (t *pollingTransport) CheckTestCase(ctx context.Context, request syncTestCaseRequestModel) (*syncTestCaseResponseModel, error) {
+	var response syncTestCaseResponseModel
+	if err := t.postJSON(ctx, t.client, "/checkTestCase/", request, &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// download sends the request without the request timeout, since test data may take longer, it is
+// cancelled instead once no data arrives for the idle timeout, while waiting for the response or reading it
+func (t *pollingTransport) download(request *http.Request) (*http.Response, error) {
+	client := &http.Client{Transport: t.client.Transport}
+	if t.idleTimeout <= 0 {
+		return client.Do(request)
+	}
+	ctx, cancel := context.WithCancel(request.Context())
+	timer := time.AfterFunc(t.idleTimeout, cancel)
+	response, err := client.Do(request.WithContext(ctx))
+	if err != nil {
+		timer.Stop()
+		if ctx.Err() != nil && request.Context().Err() == nil {
+			err = fmt.Errorf("no response for %s", t.idleTimeout)
+		}
+		cancel()
+		return nil, err
+	}
+	timer.Reset(t.idleTimeout)
+	response.Body = &idleBody{body: response.Body, ctx: ctx, cancel: cancel, timer: timer, timeout: t.idleTimeout}
+	return response, nil
+}
+
+func (t *pollingTransport) DownloadTestCase(ctx context.Context, pid int64, filename string) (io.ReadCloser, error) {
+	query := url.Values{}
+	query.Set("pid", fmt.Sprint(pid))
+	query.Set("filename", filename)
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, t.baseURL+"/downloadTestCase/?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := t.download(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		_ = response.Body.Close()
+		return nil, fmt.Errorf("download %s: %s", filename, response.Status)
+	}
+	return response.Body, nil
+}
+
+func (t *pollingTransport) DownloadTestCaseBundle(ctx context.Context, pid int64, filenames []string) (io.ReadCloser, error) {
+	data, err := json.Marshal(syncTestCaseBundleRequestModel{Pid: pid, Filenames: filenames})
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, t.baseURL+"/downloadTestCaseBundle/", bytes.NewBuffer(data))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := t.download(request)
+	if err != nil {
+		return nil, err
+	}
+	switch response.StatusCode {
+	case http.StatusOK:
+		return response.Body, nil
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		_ = response.Body.Close()
+		return nil, errBundleUnsupported
+	default:
+		_ = response.Body.Close()
+		return nil, fmt.Errorf("download bundle: %s", response.Status)
+	}
+}
+
+func (t *pollingTransport) Streaming() bool {
+	return false
+}
+
+// longPollTransport holds mission requests on the server until missions or commands arrive,
+// statuses are pushed in requests of their own
+type longPollTransport struct {
+	*pollingTransport
+	wait time.Duration
+}
+
+func (t *longPollTransport) FetchMissions(ctx context.Context, request MissionRequestModel) (*MissionResponseModel, error) {
+	client := &http.Client{Transport: t.client.Transport, Timeout: t.wait + t.client.Timeout}
+	path := fmt.Sprintf("/api/core/j2s/?wait=%d", int(t.wait/time.Second))
+	var response MissionResponseModel
+	if err := t.postJSON(ctx, client, path, request, &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+func (t *longPollTransport) Streaming() bool {
+	return true
+}
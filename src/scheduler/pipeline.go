@@ -0,0 +1,158 @@
+package scheduler
+
+import (
+	"config"
+	"context"
+	"fmt"
+	"machine"
+	"model"
+	"network"
+	"sync"
+	"utils"
+)
+
+// compiledMission is handed from the compile stage to the run stage, its workspace holds the compiled artifact
+type compiledMission struct {
+	machine machine.Machine
+	ctx     context.Context
+	done    func(judged bool)
+}
+
+// Pipeline compiles and judges missions in two stages with worker pools sized independently,
+// so that slow compilers don't hold judge slots
+type Pipeline struct {
+	pool           *Pool
+	compileWorkers int
+	// reserved workers of both stages only take high-priority missions
+	reservedCompileWorkers int
+	reservedRunWorkers     int
+	runQueue               chan compiledMission
+	highRunQueue           chan compiledMission
+}
+
+func NewPipeline(pool *Pool) *Pipeline {
+	compileWorkers := config.GlobalConfig.Judge.CompileWorkers
+	if compileWorkers <= 0 {
+		compileWorkers = utils.Max(1, len(pool.CompileCPUs()))
+	}
+	reservedSlots := config.GlobalConfig.Queue.ReservedSlots
+	return &Pipeline{
+		pool:                   pool,
+		compileWorkers:         compileWorkers,
+		reservedCompileWorkers: utils.Max(0, utils.Min(reservedSlots, compileWorkers-1)),
+		reservedRunWorkers:     utils.Max(0, utils.Min(reservedSlots, pool.Size()-1)),
+		runQueue:               make(chan compiledMission, pool.Size()),
+		highRunQueue:           make(chan compiledMission, pool.Size()),
+	}
+}
+
+// compileCPU is the cpu the compile worker is pinned to, workers share the compile cpus in turn,
+// -1 leaves them unpinned if there is none
+func (p *Pipeline) compileCPU(worker int) int {
+	cpus := p.pool.CompileCPUs()
+	if len(cpus) == 0 {
+		return -1
+	}
+	return cpus[worker%len(cpus)]
+}
+
+// compileWorker compiles missions until fetchCtx is done, runs are cancelled through runCtx
+func (p *Pipeline) compileWorker(fetchCtx context.Context, runCtx context.Context, reserved bool, cpu int) {
+	for {
+		mission := network.FetchMission(fetchCtx, reserved)
+		if mission == nil {
+			return
+		}
+		ctx, done := network.StartRun(runCtx, mission.Rid)
+		m := machine.NewMachine(mission)
+		if m == nil {
+			// the mission is dispatched already, it is finished like a run so that it leaves the journal
+			reason := fmt.Sprintf("language %d is not supported", mission.Language)
+			network.LogError(mission.Pid, fmt.Sprintf("[Rid:%d] %s", mission.Rid, reason))
+			network.SendStatus(model.StatusModel{
+				Rid:        mission.Rid,
+				Pid:        mission.Pid,
+				Status:     model.JudgeStatusSystemError,
+				TimeCost:   -1,
+				MemoryCost: -1,
+				Reason:     reason,
+			})
+			done(false)
+			continue
+		}
+		if !m.Compile(ctx, m, cpu) {
+			done(false)
+			continue
+		}
+		compiled := compiledMission{machine: m, ctx: ctx, done: done}
+		if network.IsHighPriority(*mission) {
+			p.highRunQueue <- compiled
+		} else {
+			p.runQueue <- compiled
+		}
+	}
+}
+
+// runWorker judges compiled missions in a slot until both run queues are closed,
+// high-priority missions go first and a reserved worker takes nothing else
+func (p *Pipeline) runWorker(reserved bool) {
+	highRunQueue, runQueue := p.highRunQueue, p.runQueue
+	if reserved {
+		runQueue = nil
+	}
+	for highRunQueue != nil || runQueue != nil {
+		var compiled compiledMission
+		var ok, high bool
+		select {
+		case compiled, ok = <-highRunQueue:
+			high = true
+		default:
+			select {
+			case compiled, ok = <-highRunQueue:
+				high = true
+			case compiled, ok = <-runQueue:
+			}
+		}
+		if !ok {
+			if high {
+				highRunQueue = nil
+			} else {
+				runQueue = nil
+			}
+			continue
+		}
+		slot := p.pool.Acquire()
+		compiled.done(compiled.machine.Judge(compiled.ctx, compiled.machine, slot.CPU))
+		p.pool.Release(slot)
+	}
+}
+
+// Start runs the workers of both stages, the returned channel is closed once every worker has exited
+// after fetchCtx is done
+func (p *Pipeline) Start(fetchCtx context.Context, runCtx context.Context) <-chan struct{} {
+	var compileGroup, runGroup sync.WaitGroup
+	for i := 0; i < p.compileWorkers; i++ {
+		compileGroup.Add(1)
+		go func(reserved bool, cpu int) {
+			defer compileGroup.Done()
+			p.compileWorker(fetchCtx, runCtx, reserved, cpu)
+		}(i < p.reservedCompileWorkers, p.compileCPU(i))
+	}
+	for i := 0; i < p.pool.Size(); i++ {
+		runGroup.Add(1)
+		go func(reserved bool) {
+			defer runGroup.Done()
+			p.runWorker(reserved)
+		}(i < p.reservedRunWorkers)
+	}
+	done := make(chan struct{})
+	go func() {
+		// the run stage drains what the compile stage has handed over
+		compileGroup.Wait()
+		close(p.highRunQueue)
+		close(p.runQueue)
+		runGroup.Wait()
+		close(done)
+	}()
+	return done
+}
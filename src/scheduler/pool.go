@@ -0,0 +1,161 @@
+package scheduler
+
+import (
+	"config"
+	"fmt"
+	"utils"
+)
+
+// Slot is a judge slot, runs in the slot are pinned to its cpu
+type Slot struct {
+	Index int
+	CPU   int
+}
+
+// Pool bounds the number of concurrent runs
+type Pool struct {
+	slots chan Slot
+	size  int
+	// compileCPUs are the cpus outside the slots compilations are pinned to
+	compileCPUs []int
+}
+
+// selectCPUs picks a dedicated cpu per slot, skipping hyperthread siblings if configured
+func selectCPUs(judgeConfig config.Judge) ([]int, error) {
+	available, err := utils.AvailableCPUs()
+	if err != nil {
+		return nil, err
+	}
+	candidates := available
+	if judgeConfig.Cpus != "" {
+		if candidates, err = utils.ParseCPUList(judgeConfig.Cpus); err != nil {
+			return nil, fmt.Errorf("invalid cpu list %s", judgeConfig.Cpus)
+		}
+		allowed := map[int]bool{}
+		for _, cpu := range available {
+			allowed[cpu] = true
+		}
+		for _, cpu := range candidates {
+			if !allowed[cpu] {
+				return nil, fmt.Errorf("cpu %d is not available", cpu)
+			}
+		}
+	}
+	if !judgeConfig.AvoidSiblings {
+		return candidates, nil
+	}
+	var cpus []int
+	used := map[int]bool{}
+	for _, cpu := range candidates {
+		if used[cpu] {
+			continue
+		}
+		for _, sibling := range utils.ThreadSiblings(cpu) {
+			used[sibling] = true
+		}
+		cpus = append(cpus, cpu)
+	}
+	return cpus, nil
+}
+
+// selectCompileCPUs picks the cpus compilations are pinned to, none of them may be a slot's cpu or,
+// if siblings are avoided, a sibling of it
+func selectCompileCPUs(judgeConfig config.Judge, slotCPUs []int) ([]int, error) {
+	available, err := utils.AvailableCPUs()
+	if err != nil {
+		return nil, err
+	}
+	reserved := map[int]bool{}
+	for _, cpu := range slotCPUs {
+		reserved[cpu] = true
+		if judgeConfig.AvoidSiblings {
+			for _, sibling := range utils.ThreadSiblings(cpu) {
+				reserved[sibling] = true
+			}
+		}
+	}
+	if judgeConfig.CompileCpus == "" {
+		var cpus []int
+		for _, cpu := range available {
+			if !reserved[cpu] {
+				cpus = append(cpus, cpu)
+			}
+		}
+		return cpus, nil
+	}
+	cpus, err := utils.ParseCPUList(judgeConfig.CompileCpus)
+	if err != nil {
+		return nil, fmt.Errorf("invalid compile cpu list %s", judgeConfig.CompileCpus)
+	}
+	allowed := map[int]bool{}
+	for _, cpu := range available {
+		allowed[cpu] = true
+	}
+	for _, cpu := range cpus {
+		if !allowed[cpu] {
+			return nil, fmt.Errorf("compile cpu %d is not available", cpu)
+		}
+		if reserved[cpu] {
+			return nil, fmt.Errorf("compile cpu %d is dedicated to a slot", cpu)
+		}
+	}
+	return cpus, nil
+}
+
+// NewPool creates the judge slots and picks the compile cpus from config
+func NewPool() *Pool {
+	judgeConfig := config.GlobalConfig.Judge
+	cpus, err := selectCPUs(judgeConfig)
+	if err != nil {
+		panic(err)
+	}
+	size := judgeConfig.Slots
+	if size <= 0 {
+		size = len(cpus)
+		if judgeConfig.CompileCpus == "" && size > 1 {
+			// keep a cpu for compiling if the slots would take every one
+			if compileCPUs, err := selectCompileCPUs(judgeConfig, cpus); err == nil && len(compileCPUs) == 0 {
+				size--
+			}
+		}
+	}
+	if size > len(cpus) {
+		utils.Log(utils.LogTypeWarning, fmt.Sprintf("%d slots configured but only %d dedicated cpu(s), use %d slots", size, len(cpus), len(cpus)))
+		size = len(cpus)
+	}
+	compileCPUs, err := selectCompileCPUs(judgeConfig, cpus[:size])
+	if err != nil {
+		panic(err)
+	}
+	if len(compileCPUs) == 0 {
+		utils.Log(utils.LogTypeWarning, "no cpu left for compiling, compilations run unpinned")
+	}
+	pool := &Pool{
+		slots:       make(chan Slot, size),
+		size:        size,
+		compileCPUs: compileCPUs,
+	}
+	for i := 0; i < size; i++ {
+		pool.slots <- Slot{Index: i, CPU: cpus[i]}
+		utils.Log(utils.LogTypeNormal, fmt.Sprintf("[Slot:%d] pinned to cpu %d", i, cpus[i]))
+	}
+	return pool
+}
+
+// Acquire blocks until a slot is free
+func (p *Pool) Acquire() Slot {
+	return <-p.slots
+}
+
+func (p *Pool) Release(slot Slot) {
+	p.slots <- slot
+}
+
+func (p *Pool) Size() int {
+	return p.size
+}
+
+// CompileCPUs are the cpus compilations are pinned to, empty if every cpu belongs to a slot
+func (p *Pool) CompileCPUs() []int {
+	return p.compileCPUs
+}
@@ -0,0 +1,159 @@
+package testcase
+
+import (
+	"config"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+func testCaseBudget() int64 {
+	return int64(config.GlobalConfig.Cache.TestCaseSize) * 1024 * 1024
+}
+
+func directorySize(dir string) int64 {
+	var size int64
+	_ = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// loadSizes indexes the test data left by previous runs once, the modification time of the version directory
+// tells when the problem was judged last, lock must not be held
+func (s *TestCaseStore) loadSizes() {
+	s.sizesOnce.Do(func() {
+		entries, err := ioutil.ReadDir(filepath.Join(config.GlobalConfig.Path.Data, versionsDirectoryName))
+		if err != nil {
+			return
+		}
+		sizes := map[int64]int64{}
+		lastUsed := map[int64]time.Time{}
+		for _, entry := range entries {
+			pid, err := strconv.ParseInt(entry.Name(), 10, 64)
+			if err != nil || !entry.IsDir() {
+				continue
+			}
+			sizes[pid] = directorySize(VersionsDir(pid))
+			if info, err := os.Stat(Dir(pid)); err == nil {
+				lastUsed[pid] = info.ModTime()
+			}
+		}
+		s.lock.Lock()
+		for pid, size := range sizes {
+			p := s.problemOf(pid)
+			s.totalSize += size - p.size
+			p.size = size
+			if p.lastUsed.IsZero() {
+				p.lastUsed = lastUsed[pid]
+			}
+		}
+		s.lock.Unlock()
+	})
+}
+
+// touch records that the problem is judged, lock must be held
+func (s *TestCaseStore) touch(p *problem) {
+	p.lastUsed = time.Now()
+	if p.dir != "" {
+		_ = os.Chtimes(p.dir, p.lastUsed, p.lastUsed)
+	}
+}
+
+// resize accounts the size of the problem after an update, lock must be held
+func (s *TestCaseStore) resize(p *problem, size int64) {
+	s.totalSize += size - p.size
+	p.size = size
+}
+
+// selectVictims marks the least recently judged problems to evict for the budget to be met, problems being
+// leased, updated or evicted already are skipped as well as busy ones, lock must be held
+func (s *TestCaseStore) selectVictims(budget int64, busy map[int64]bool) []int64 {
+	excess := s.totalSize - s.evictingSize - budget
+	var victims []int64
+	for excess > 0 {
+		var oldestPid int64
+		var oldest *problem
+		for pid, p := range s.problems {
+			if p.size == 0 || p.leases > 0 || p.update != nil || p.updating || p.sharing || p.evicting || busy[pid] {
+				continue
+			}
+			if oldest == nil || p.lastUsed.Before(oldest.lastUsed) {
+				oldestPid, oldest = pid, p
+			}
+		}
+		if oldest == nil {
+			break
+		}
+		oldest.evicting = true
+		s.evictingSize += oldest.size
+		excess -= oldest.size
+		victims = append(victims, oldestPid)
+	}
+	if excess > 0 && s.evictingSize == 0 {
+		logWarning(0, fmt.Sprintf("test data takes %d MB beyond the budget, every problem is in use", excess/1024/1024))
+	}
+	return victims
+}
+
+// removeTestCase removes the test data of the problem unless another judger process is reading or updating it
+func removeTestCase(pid int64) (bool, error) {
+	exclusive, err := lockProblem(pid, syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		return false, nil
+	}
+	defer unlockProblem(exclusive)
+	if err := os.Remove(Dir(pid)); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	return true, os.RemoveAll(VersionsDir(pid))
+}
+
+// evict removes the test data of the least recently judged problems until the budget is met, problems
+// being leased or updated are never evicted, by this process or another one. The victims are marked under
+// the lock and removed outside it, lock must not be held
+func (s *TestCaseStore) evict() {
+	budget := testCaseBudget()
+	if budget <= 0 {
+		return
+	}
+	s.loadSizes()
+	busy := map[int64]bool{}
+	for {
+		s.lock.Lock()
+		victims := s.selectVictims(budget, busy)
+		s.lock.Unlock()
+		if len(victims) == 0 {
+			return
+		}
+		for _, pid := range victims {
+			removed, err := removeTestCase(pid)
+			if err != nil {
+				logError(pid, "evict test data fail: "+err.Error())
+			}
+			s.lock.Lock()
+			p := s.problemOf(pid)
+			p.evicting = false
+			s.evictingSize -= p.size
+			if removed && err == nil {
+				logNormal(pid, fmt.Sprintf("evict %d KB of test data", p.size/1024))
+				s.totalSize -= p.size
+				p.size = 0
+				p.dir, p.version = "", ""
+			} else {
+				// another judger process is using it, or it can't be removed
+				busy[pid] = true
+			}
+			s.startUpdate(pid, p)
+			s.cond.Broadcast()
+			s.lock.Unlock()
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package testcase
+
+import (
+	"config"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Every update builds a new version directory under .versions/<pid>, the testcase directory <pid> is a symlink
+// switched to it atomically, so that a judge sees either the old test data or the new one as a whole
+
+const versionsDirectoryName = ".versions"
+
+// Dir is the testcase directory of the problem, a symlink to its current version
+func Dir(pid int64) string {
+	return fmt.Sprintf("%s%d", config.GlobalConfig.Path.Data, pid)
+}
+
+// VersionsDir holds the version directories of the problem
+func VersionsDir(pid int64) string {
+	return filepath.Join(config.GlobalConfig.Path.Data, versionsDirectoryName, fmt.Sprint(pid))
+}
+
+// SyncDirectory flushes the entries of dir to disk
+func SyncDirectory(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	return file.Sync()
+}
+
+// switchVersion points the testcase directory to the version directory, a plain directory left by an older
+// judger is retired into the versions directory first
+func switchVersion(pid int64, versionDir string) error {
+	link := Dir(pid)
+	if info, err := os.Lstat(link); err == nil && info.Mode()&os.ModeSymlink == 0 {
+		legacyDir := filepath.Join(VersionsDir(pid), fmt.Sprintf("legacy-%d", time.Now().UnixNano()))
+		if err := os.Rename(link, legacyDir); err != nil {
+			return err
+		}
+	}
+	target, err := filepath.Rel(filepath.Dir(link), versionDir)
+	if err != nil {
+		return err
+	}
+	tempLink := link + ".link"
+	_ = os.Remove(tempLink)
+	if err := os.Symlink(target, tempLink); err != nil {
+		return err
+	}
+	if err := os.Rename(tempLink, link); err != nil {
+		_ = os.Remove(tempLink)
+		return err
+	}
+	return SyncDirectory(filepath.Dir(link))
+}
+
+// removeOldVersions removes every version but the current one, no lease may be held
+func removeOldVersions(pid int64, currentDir string) {
+	entries, err := ioutil.ReadDir(VersionsDir(pid))
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.Name() == filepath.Base(currentDir) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(VersionsDir(pid), entry.Name())); err != nil {
+			logWarning(pid, fmt.Sprintf("remove test case version %s fail", entry.Name()))
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package testcase
+
+import (
+	"config"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Judger processes sharing Path.Data coordinate through a flock per problem, leases hold it shared so that
+// no other process switches or removes the test data being read, updates hold it exclusively so that one
+// process downloads while the others wait and then find the test data up to date
+
+const locksDirectoryName = ".locks"
+
+func lockPath(pid int64) string {
+	return filepath.Join(config.GlobalConfig.Path.Data, locksDirectoryName, fmt.Sprintf("%d.lock", pid))
+}
+
+func flock(file *os.File, how int) error {
+	for {
+		if err := syscall.Flock(int(file.Fd()), how); err != syscall.EINTR {
+			return err
+		}
+	}
+}
+
+// lockProblem opens the lock file of the problem and flocks it, how is syscall.LOCK_SH or syscall.LOCK_EX,
+// optionally with syscall.LOCK_NB
+func lockProblem(pid int64, how int) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(lockPath(pid)), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(lockPath(pid), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := flock(file, how); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func unlockProblem(file *os.File) {
+	_ = flock(file, syscall.LOCK_UN)
+	_ = file.Close()
+}
@@ -0,0 +1,73 @@
+package testcase
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ManifestFileName keeps the manifest of a version in its directory
+const ManifestFileName = ".manifest.json"
+
+// File is an entry of the manifest, Name is relative to the testcase directory
+type File struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Manifest describes the test data of a problem, Version changes whenever any file does
+type Manifest struct {
+	Version string `json:"version"`
+	Files   []File `json:"files"`
+}
+
+// IsSafeName rejects names escaping the testcase directory or hiding among the judger's own files
+func IsSafeName(name string) bool {
+	if name == "" || path.IsAbs(name) || strings.Contains(name, "\\") || path.Clean(name) != name {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." || strings.HasPrefix(part, ".") {
+			return false
+		}
+	}
+	return true
+}
+
+// ReadManifest loads the manifest of the version in dir, nil if there is none
+func ReadManifest(dir string) *Manifest {
+	data, err := ioutil.ReadFile(filepath.Join(dir, ManifestFileName))
+	if err != nil {
+		return nil
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil
+	}
+	return &manifest
+}
+
+// WriteManifest stores the manifest into the version directory being built
+func WriteManifest(dir string, manifest Manifest) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, ManifestFileName), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,32 @@
+package testcase
+
+import "testing"
+
+func TestIsSafeName(t *testing.T) {
+	tests := []struct {
+		name string
+		safe bool
+	}{
+		{"1.in", true},
+		{"data/1.out", true},
+		{"a..b", true},
+		{"", false},
+		{"/etc/passwd", false},
+		{"..", false},
+		{"../1.in", false},
+		{"data/../../1.in", false},
+		{"data/../1.in", false},
+		{"./1.in", false},
+		{"data//1.in", false},
+		{"data/", false},
+		{"data\\1.in", false},
+		{ManifestFileName, false},
+		{".lock", false},
+		{"data/.hidden", false},
+	}
+	for _, test := range tests {
+		if safe := IsSafeName(test.name); safe != test.safe {
+			t.Errorf("IsSafeName(%q) = %v, want %v", test.name, safe, test.safe)
+		}
+	}
+}
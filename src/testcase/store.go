@@ -0,0 +1,264 @@
+package testcase
+
+import (
+	"config"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+	"utils"
+)
+
+// problem is the state of the test data of a problem
+type problem struct {
+	// dir is the resolved version directory and version its data version, dir is empty until resolved
+	dir     string
+	version string
+	leases  int
+	// update is set once an update is requested, it waits for the last lease to be released
+	update   func() (string, error)
+	done     func(err error)
+	updating bool
+	// size is the disk usage of the versions of the problem
+	size     int64
+	lastUsed time.Time
+	// evicting is set while the test data is being removed outside the lock
+	evicting bool
+	// shared is the flock held while the problem is leased, sharing is set while it is being taken
+	shared  *os.File
+	sharing bool
+}
+
+// TestCaseStore owns the test data of every problem, judges read it under leases and updates only run
+// once no lease is held, leases requested meanwhile are refused until the update completes
+type TestCaseStore struct {
+	lock     sync.Mutex
+	cond     *sync.Cond
+	problems map[int64]*problem
+	// totalSize is the disk usage of every problem, evictingSize the part of it being evicted
+	totalSize    int64
+	evictingSize int64
+	sizesOnce    sync.Once
+}
+
+// Lease pins a version of the test data of a problem for a run, it must be released when the run completes
+type Lease struct {
+	Pid     int64
+	Dir     string
+	Version string
+	store   *TestCaseStore
+	once    sync.Once
+}
+
+var Store = NewTestCaseStore()
+
+const lockPollInterval = 200 * time.Millisecond
+
+// ErrUpdating is returned by Acquire while the test data is updated, by this process or another one
+var ErrUpdating = errors.New("test data is being updated")
+
+// ErrNotPresent is returned by Acquire when there is no test data, e.g. it has been evicted
+var ErrNotPresent = errors.New("test data not present")
+
+func NewTestCaseStore() *TestCaseStore {
+	store := &TestCaseStore{problems: map[int64]*problem{}}
+	store.cond = sync.NewCond(&store.lock)
+	return store
+}
+
+func logNormal(pid int64, content string) {
+	utils.Log(utils.LogTypeNormal, fmt.Sprintf("[Pid:%d] %s", pid, content))
+}
+
+func logWarning(pid int64, content string) {
+	utils.Log(utils.LogTypeWarning, fmt.Sprintf("[Pid:%d] %s", pid, content))
+}
+
+func logError(pid int64, content string) {
+	utils.Log(utils.LogTypeError, fmt.Sprintf("[Pid:%d] %s", pid, content))
+}
+
+// problemOf returns the state of the problem, lock must be held
+func (s *TestCaseStore) problemOf(pid int64) *problem {
+	p, ok := s.problems[pid]
+	if !ok {
+		p = &problem{}
+		s.problems[pid] = p
+	}
+	return p
+}
+
+// Acquire leases the current version of the test data of the problem, it never waits for an update,
+// so that the caller can put the run aside until the test data is there. The first lease of the problem
+// takes the flock shared, which fails while another judger process updates it
+func (s *TestCaseStore) Acquire(pid int64) (*Lease, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	p := s.problemOf(pid)
+	for p.shared == nil && p.sharing {
+		s.cond.Wait()
+	}
+	if p.update != nil || p.updating {
+		return nil, ErrUpdating
+	}
+	if p.evicting {
+		return nil, ErrNotPresent
+	}
+	if p.shared == nil {
+		p.sharing = true
+		s.lock.Unlock()
+		shared, err := lockProblem(pid, syscall.LOCK_SH|syscall.LOCK_NB)
+		s.lock.Lock()
+		p.sharing = false
+		s.cond.Broadcast()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrUpdating
+		}
+		if err != nil {
+			return nil, err
+		}
+		if p.update != nil || p.updating || p.evicting {
+			unlockProblem(shared)
+			return nil, ErrUpdating
+		}
+		// another process may have switched or evicted the test data since the last lease, the symlink is
+		// followed since a process dying halfway through an eviction leaves it dangling
+		dir, err := filepath.EvalSymlinks(Dir(pid))
+		if err == nil {
+			_, err = os.Stat(dir)
+		}
+		if err != nil {
+			unlockProblem(shared)
+			s.totalSize -= p.size
+			p.size = 0
+			p.dir, p.version = "", ""
+			return nil, ErrNotPresent
+		}
+		p.shared, p.dir, p.version = shared, dir, ""
+		if manifest := ReadManifest(dir); manifest != nil {
+			p.version = manifest.Version
+		}
+	}
+	s.touch(p)
+	p.leases++
+	return &Lease{Pid: pid, Dir: p.dir, Version: p.version, store: s}, nil
+}
+
+// Release gives the lease back, a pending update starts once the last lease of the problem is released
+func (l *Lease) Release() {
+	l.once.Do(func() {
+		l.store.lock.Lock()
+		p := l.store.problemOf(l.Pid)
+		p.leases--
+		if p.leases == 0 && p.shared != nil {
+			unlockProblem(p.shared)
+			p.shared = nil
+		}
+		l.store.startUpdate(l.Pid, p)
+		released := p.leases == 0
+		l.store.lock.Unlock()
+		if released {
+			l.store.evict()
+		}
+	})
+}
+
+// Updating reports whether an update of the problem is pending or running
+func (s *TestCaseStore) Updating(pid int64) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	p := s.problemOf(pid)
+	return p.update != nil || p.updating
+}
+
+// RequestUpdate schedules an update of the problem unless one is pending or running already, it reports
+// whether it is scheduled. update builds a new version directory, or returns an empty one if nothing changed,
+// the store switches to it and done receives the error afterwards
+func (s *TestCaseStore) RequestUpdate(pid int64, update func() (string, error), done func(err error)) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	p := s.problemOf(pid)
+	if p.update != nil || p.updating {
+		return false
+	}
+	p.update, p.done = update, done
+	if p.leases > 0 {
+		logNormal(pid, fmt.Sprintf("update waits for %d lease(s)", p.leases))
+	}
+	s.startUpdate(pid, p)
+	return true
+}
+
+// startUpdate runs the pending update if no lease is held and the problem isn't being evicted, lock must be held
+func (s *TestCaseStore) startUpdate(pid int64, p *problem) {
+	if p.update == nil || p.updating || p.leases > 0 || p.evicting {
+		return
+	}
+	update, done := p.update, p.done
+	p.update, p.done = nil, nil
+	p.updating = true
+	go s.runUpdate(pid, p, update, done)
+}
+
+// lockExclusively takes the flock of the problem exclusively, waiting up to Sync.LockTimeout for another
+// judger process to finish with the test data, a blocking flock couldn't be given up
+func lockExclusively(pid int64) (*os.File, error) {
+	deadline := time.Now().Add(time.Duration(config.GlobalConfig.Sync.LockTimeout) * time.Second)
+	for waiting := false; ; waiting = true {
+		exclusive, err := lockProblem(pid, syscall.LOCK_EX|syscall.LOCK_NB)
+		if err != syscall.EWOULDBLOCK {
+			return exclusive, err
+		}
+		if time.Now().After(deadline) {
+			return nil, errors.New("test data is held by another judger for too long")
+		}
+		if !waiting {
+			logNormal(pid, "update waits for another judger")
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// runUpdate holds the flock of the problem exclusively, so that a concurrent update of another judger
+// process completes first and this one finds the test data up to date
+func (s *TestCaseStore) runUpdate(pid int64, p *problem, update func() (string, error), done func(err error)) {
+	exclusive, err := lockExclusively(pid)
+	versionDir := ""
+	if err != nil {
+		logError(pid, "lock test data fail: "+err.Error())
+	} else {
+		versionDir, err = update()
+		if err == nil && versionDir != "" {
+			if err = switchVersion(pid, versionDir); err != nil {
+				logError(pid, "switch version fail: "+err.Error())
+				_ = os.RemoveAll(versionDir)
+			} else {
+				removeOldVersions(pid, versionDir)
+			}
+		}
+		unlockProblem(exclusive)
+	}
+	if err == nil && versionDir != "" {
+		s.loadSizes()
+		size := directorySize(VersionsDir(pid))
+		s.lock.Lock()
+		p.dir, p.version = versionDir, ""
+		if manifest := ReadManifest(versionDir); manifest != nil {
+			p.version = manifest.Version
+		}
+		logNormal(pid, fmt.Sprintf("switch to version %s", p.version))
+		s.touch(p)
+		s.resize(p, size)
+		s.lock.Unlock()
+		// the problem is about to be judged, it is still marked updating so that it isn't evicted itself
+		s.evict()
+	}
+	s.lock.Lock()
+	p.updating = false
+	s.cond.Broadcast()
+	s.lock.Unlock()
+	done(err)
+}
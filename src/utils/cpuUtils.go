@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// cpuMask covers 1024 cpus like the glibc cpu_set_t
+type cpuMask [16]uint64
+
+// SetThreadAffinity pins the calling thread to the cpu, processes started from the thread inherit it
+func SetThreadAffinity(cpu int) error {
+	var mask cpuMask
+	if cpu < 0 || cpu >= len(mask)*64 {
+		return fmt.Errorf("cpu %d out of range", cpu)
+	}
+	mask[cpu/64] |= 1 << (uint(cpu) % 64)
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0, unsafe.Sizeof(mask), uintptr(unsafe.Pointer(&mask)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// AvailableCPUs returns the cpus the current process may run on
+func AvailableCPUs() ([]int, error) {
+	var mask cpuMask
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_GETAFFINITY, 0, unsafe.Sizeof(mask), uintptr(unsafe.Pointer(&mask)))
+	if errno != 0 {
+		return nil, errno
+	}
+	var cpus []int
+	for cpu := 0; cpu < len(mask)*64; cpu++ {
+		if mask[cpu/64]&(1<<(uint(cpu)%64)) != 0 {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+// ParseCPUList parses the kernel cpu list format, e.g. 0-3,8
+func ParseCPUList(list string) ([]int, error) {
+	var cpus []int
+	for _, part := range strings.Split(strings.TrimSpace(list), ",") {
+		if part == "" {
+			continue
+		}
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		if err != nil {
+			return nil, err
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(strings.TrimSpace(bounds[1])); err != nil {
+				return nil, err
+			}
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+// ThreadSiblings returns the hyperthreads sharing a core with the cpu, the cpu included
+func ThreadSiblings(cpu int) []int {
+	content, err := ioutil.ReadFile(fmt.Sprintf("/sys/devices/system/cpu/cpu%d/topology/thread_siblings_list", cpu))
+	if err != nil {
+		return []int{cpu}
+	}
+	siblings, err := ParseCPUList(string(content))
+	if err != nil {
+		return []int{cpu}
+	}
+	return siblings
+}